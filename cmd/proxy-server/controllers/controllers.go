@@ -6,35 +6,48 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/matching"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/pactContractHandler"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 
 	"net/http"
 	"net/url"
 
 	"github.com/gin-gonic/gin"
-	"github.com/jhump/protoreflect/dynamic"
+	"github.com/jhump/protoreflect/desc"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/encoders"
+	"google.golang.org/grpc"
 )
 
 // Mimic a dependency-injected controller setup to allow for testing.
 type fileWriter func(filename string, data []byte, perm os.FileMode) error
+type grpcDialer func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
 type Dependencies struct {
 	HttpClient        IHttpClient
 	FileWriter        fileWriter
+	GrpcDialer        grpcDialer
 	InteractionLookup *domain.InteractionLookup
+	MessageLookup     *domain.MessageLookup
 	CliArgs           *domain.CliArgs
+	// Only present if descriptors were loaded from .proto files or Buf images at startup
+	LocalDescriptors *descriptorlogic.LocalDescriptors
+	// Only present if a schema registry or schema directory was given
+	SchemaRegistry encoders.SchemaRegistry
 }
 
 func RealDependencies(args *domain.CliArgs) *Dependencies {
 	return &Dependencies{
 		HttpClient:        http.DefaultClient,
 		FileWriter:        ioutil.WriteFile,
+		GrpcDialer:        grpc.Dial,
 		InteractionLookup: domain.CreateEmptyInteractionLookup(),
+		MessageLookup:     domain.CreateEmptyMessageLookup(),
 		CliArgs:           args,
 	}
 }
@@ -128,6 +141,22 @@ func (deps Dependencies) handleInteractionAddInner(c *gin.Context) error {
 		return err
 	}
 
+	var unmarshalledInteraction = serialization.ProviderServiceInteraction{}
+	err = json.Unmarshal(jsonBytes, &unmarshalledInteraction)
+	if err != nil {
+		return err
+	}
+	// Errors in the descriptors are the caller's to fix, so are reported back rather than registered with the Ruby core
+	path := ""
+	if unmarshalledInteraction.Request.Path != nil {
+		path = unmarshalledInteraction.Request.Path.GetString()
+	}
+	err = deps.resolveEncodingDescriptors(path, unmarshalledInteraction.Request.Encoding, unmarshalledInteraction.Response.Encoding)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil
+	}
+
 	reader := bytes.NewBuffer(jsonBytes)
 	requestBody := ioutil.NopCloser(reader)
 	req := &http.Request{
@@ -140,16 +169,10 @@ func (deps Dependencies) handleInteractionAddInner(c *gin.Context) error {
 		return err
 	}
 
-	var unmarshalledInteraction = serialization.ProviderServiceInteraction{}
-	err = json.Unmarshal(jsonBytes, &unmarshalledInteraction)
-	if err != nil {
-		return err
-	}
-
 	urlIdentifier := domain.CreateUniqueInteractionIdentifierFromInteraction(&unmarshalledInteraction)
-	err = deps.InteractionLookup.Set(urlIdentifier, unmarshalledInteraction)
+	err = deps.InteractionLookup.Add(urlIdentifier, unmarshalledInteraction)
 	if err != nil {
-		fmt.Printf("Interaction duplicate: %v\n", urlIdentifier)
+		fmt.Printf("Unable to add interaction %v: %v\n", urlIdentifier, err)
 	}
 
 	resp := new(bytes.Buffer)
@@ -164,6 +187,30 @@ func (deps Dependencies) handleInteractionAddInner(c *gin.Context) error {
 	return nil
 }
 
+// Encodings may give .proto source to be compiled, or (where descriptors were loaded at startup) only the message name,
+// in place of their descriptors. Encodings framed for a schema registry may give only their subject. Once resolved, each
+// encoding is validated by its encoder.
+func (deps Dependencies) resolveEncodingDescriptors(path string, encodings ...*serialization.SerializationEncoding) error {
+	err := encoders.FillSchemaRegistryEncodings(deps.SchemaRegistry, path, encodings...)
+	if err != nil {
+		return err
+	}
+	err = descriptorlogic.CompileProtoSources(encodings...)
+	if err != nil {
+		return err
+	}
+	if twirpMethod, isTwirp := deps.twirpMethod(path); isTwirp {
+		path = twirpMethod
+	}
+	if deps.LocalDescriptors != nil {
+		err = deps.LocalDescriptors.FillEncodings(path, encodings...)
+		if err != nil {
+			return err
+		}
+	}
+	return encoders.ValidateEncodings(path, encodings...)
+}
+
 func (deps Dependencies) HandleInteractionAdd(c *gin.Context) {
 	err := deps.handleInteractionAddInner(c)
 	if err != nil {
@@ -171,6 +218,14 @@ func (deps Dependencies) HandleInteractionAdd(c *gin.Context) {
 	}
 }
 
+func copyHeaders(headers http.Header) http.Header {
+	copied := make(http.Header, len(headers))
+	for k, vArr := range headers {
+		copied[k] = append([]string(nil), vArr...)
+	}
+	return copied
+}
+
 func queryStringWithLeadingQuestionmark(queryString string) string {
 	if len(queryString) == 0 {
 		return queryString
@@ -178,8 +233,25 @@ func queryStringWithLeadingQuestionmark(queryString string) string {
 	return "?" + queryString
 }
 
+// The provider state is taken from the --provider-state-header header if present, falling back to the environment.
+func (deps Dependencies) providerStateFromRequest(c *gin.Context) (string, bool) {
+	header := deps.CliArgs.ProviderStateHeader
+	if values, present := c.Request.Header[http.CanonicalHeaderKey(header)]; header != "" && present {
+		return strings.Join(values, ", "), true
+	}
+	return os.LookupEnv(domain.ProviderStateEnvironmentVariable)
+}
+
+// The headers to send the provider: the provider state header is only of interest to the proxy.
+func (deps Dependencies) providerRequestHeaders(c *gin.Context) http.Header {
+	headers := copyHeaders(c.Request.Header)
+	if deps.CliArgs.ProviderStateHeader != "" {
+		headers.Del(deps.CliArgs.ProviderStateHeader)
+	}
+	return headers
+}
+
 func (deps Dependencies) handleVerificationDynamicEndpointsInner(c *gin.Context) error {
-	// TODO: Support custom serialization of request body
 	reqBody, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		return err
@@ -188,14 +260,49 @@ func (deps Dependencies) handleVerificationDynamicEndpointsInner(c *gin.Context)
 	if err != nil {
 		return err
 	}
+
+	providerState, providerStateKnown := deps.providerStateFromRequest(c)
+	interactionKey := domain.CreateUniqueInteractionIdentifier(
+		strings.ToLower(c.Request.Method),
+		"/"+strings.TrimLeft(c.Request.URL.Path, "/"),
+		c.Request.URL.RawQuery,
+		providerState)
+	lookedUpInteraction, success := deps.InteractionLookup.Select(interactionKey, providerStateKnown)
+	if !success {
+		return errors.New(fmt.Sprintf("Failed to look up interaction: %v", interactionKey))
+	}
+	if deps.CliArgs.GrpcProviderAddress != "" && isGrpcInteraction(&lookedUpInteraction) {
+		return deps.handleGrpcVerificationInner(c, reqBody, interactionKey, providerStateKnown, lookedUpInteraction)
+	}
+	switch protocol, twirpMethod := deps.rpcProtocol(c); {
+	case protocol != "":
+		return deps.handleFramedRpcVerificationInner(
+			c, reqBody, interactionKey, providerStateKnown, lookedUpInteraction, protocol)
+	case twirpMethod != "":
+		return deps.handleTwirpVerificationInner(
+			c, reqBody, interactionKey, providerStateKnown, lookedUpInteraction, twirpMethod)
+	}
+
+	// The Ruby verifier only knows about the JSON form of the request body, the provider expects it to be encoded.
+	requestHeaders := deps.providerRequestHeaders(c)
+	if encoder, encoded := encoders.Lookup(lookedUpInteraction.Request.Encoding); encoded && len(reqBody) > 0 {
+		reqBody, err = encoder.JsonToBinary(reqBody, lookedUpInteraction.Request.Encoding, c.Request.URL.Path)
+		if err != nil {
+			return err
+		}
+		requestHeaders.Set("Content-Type", encoder.ContentType(lookedUpInteraction.Request.Encoding))
+		requestHeaders.Set("Content-Length", strconv.Itoa(len(reqBody)))
+	}
+
 	reader := bytes.NewBuffer(reqBody)
 	requestBody := ioutil.NopCloser(reader)
 
 	req := &http.Request{
-		URL:    ul,
-		Method: c.Request.Method,
-		Header: c.Request.Header,
-		Body:   requestBody}
+		URL:           ul,
+		Method:        c.Request.Method,
+		Header:        requestHeaders,
+		Body:          requestBody,
+		ContentLength: int64(len(reqBody))}
 	response, err := deps.HttpClient.Do(req)
 	if err != nil {
 		return err
@@ -203,40 +310,35 @@ func (deps Dependencies) handleVerificationDynamicEndpointsInner(c *gin.Context)
 	responseReader := response.Body.(io.Reader)
 	contentLength := response.ContentLength
 
-	interactionKey := domain.CreateUniqueInteractionIdentifier(
-		strings.ToLower(c.Request.Method),
-		"/"+strings.TrimLeft(c.Request.URL.Path, "/"),
-		c.Request.URL.RawQuery)
-	lookedUpInteraction, success := deps.InteractionLookup.Get(interactionKey)
+	responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(
+		interactionKey, providerStateKnown, response.StatusCode)
 	if !success {
-		return errors.New(fmt.Sprintf("Failed to look up interaction: %v", lookedUpInteraction))
+		responseInteraction = lookedUpInteraction
 	}
-	if lookedUpInteraction.Response.Encoding != nil && lookedUpInteraction.Response.Encoding.Type == "protobuf" {
-		msgDescriptor, err := descriptorlogic.GetMessageDescriptorFromBody(lookedUpInteraction.Response.Encoding, c.Request.URL.Path)
-		if err != nil {
-			return err
-		}
-
+	if encoder, encoded := encoders.Lookup(responseInteraction.Response.Encoding); encoded {
 		responseBody, err := ioutil.ReadAll(response.Body)
 		if err != nil {
 			return err
 		}
 
-		protoMessage := dynamic.NewMessage(msgDescriptor)
-		err = protoMessage.Unmarshal(responseBody)
+		encoded, err := encoder.BinaryToJson(responseBody, responseInteraction.Response.Encoding, c.Request.URL.Path)
 		if err != nil {
 			return err
 		}
 
-		encoded, err := protoMessage.MarshalJSONIndent()
-		if err != nil {
-			return err
+		if success {
+			msgDescriptor, err := encoders.MessageDescriptor(encoder, responseInteraction.Response.Encoding, c.Request.URL.Path)
+			if err != nil {
+				return err
+			}
+			err = reportBodyMismatches(c, responseInteraction.Description,
+				responseInteraction.Response.Body, encoded, responseInteraction.Response.MatchingRules, msgDescriptor)
+			if err != nil {
+				return err
+			}
 		}
 		responseReader = bytes.NewReader(encoded)
-		fmt.Println("Encoded contents:")
-		fmt.Println(encoded)
-		fmt.Println(len(encoded))
-		contentLength = int64(cap(encoded))
+		contentLength = int64(len(encoded))
 	}
 
 	for k, vArr := range response.Header {
@@ -253,6 +355,31 @@ func (deps Dependencies) handleVerificationDynamicEndpointsInner(c *gin.Context)
 	return nil
 }
 
+// The header listing the body mismatches found during verification, one value per mismatch.
+const bodyMismatchHeader = "X-Pact-Proxy-Mismatch"
+
+// The Ruby verifier applies the matching rules to the JSON decoded from the provider's body too, reporting mismatches
+// by JSON path, but can't say which protobuf field is at fault. The mismatches found here are reported by proto field
+// path in the proxy's output and in a header of the response, which is otherwise passed on unchanged.
+func reportBodyMismatches(c *gin.Context, description string, expected *serialization.PactRequestBody, actual []byte,
+	matchingRules interface{}, msgDescriptor *desc.MessageDescriptor) error {
+	if expected == nil {
+		return nil
+	}
+	mismatches, err := matching.CheckBody([]byte(expected.GetString()), actual, matchingRules, msgDescriptor)
+	if err != nil || len(mismatches) == 0 {
+		return err
+	}
+
+	report := fmt.Sprintf("Body mismatches for %q:", description)
+	for _, mismatch := range mismatches {
+		c.Writer.Header().Add(bodyMismatchHeader, mismatch.String())
+		report += "\n  " + mismatch.String()
+	}
+	fmt.Println(report)
+	return nil
+}
+
 func (deps Dependencies) HandleVerificationDynamicEndpoints(c *gin.Context) {
 	err := deps.handleVerificationDynamicEndpointsInner(c)
 	if err != nil {
@@ -261,33 +388,70 @@ func (deps Dependencies) HandleVerificationDynamicEndpoints(c *gin.Context) {
 	}
 }
 
+// Requests framed as gRPC-Web or Connect are RPCs of that protocol, and failing that requests under the Twirp prefix are
+// Twirp RPCs. Consumer and provider requests are both interpreted this way, so that the two agree.
+func (deps Dependencies) rpcProtocol(c *gin.Context) (protocol string, twirpMethod string) {
+	if protocol := framedRpcProtocol(c.GetHeader("Content-Type")); protocol != "" {
+		return protocol, ""
+	}
+	if fullMethod, isTwirp := deps.twirpMethod(c.Request.URL.Path); isTwirp {
+		return "", fullMethod
+	}
+	return "", ""
+}
+
 func (deps Dependencies) handleDynamicEndpointsInner(c *gin.Context) error {
+	switch protocol, twirpMethod := deps.rpcProtocol(c); {
+	case protocol != "":
+		return deps.handleFramedRpcInner(c, protocol)
+	case twirpMethod != "":
+		return deps.handleTwirpInner(c, twirpMethod)
+	}
 	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + c.Request.URL.Path + "?" + c.Request.URL.RawQuery)
 	if err != nil {
 		return err
 	}
-	jsonBytes, err := ioutil.ReadAll(c.Request.Body)
+	requestBytes, err := ioutil.ReadAll(c.Request.Body)
 	if err != nil {
 		return err
 	}
-	reader := bytes.NewBuffer(jsonBytes)
+
+	// The consumer doesn't know which provider state it's being tested against, only the Ruby core does: where several
+	// interactions share the endpoint, the request body is decoded as the first registered expects. The response is
+	// encoded as the interaction with the status the core returns expects.
+	interactionKey := domain.CreateUniqueInteractionIdentifier(
+		strings.ToLower(c.Request.Method),
+		c.Request.URL.Path,
+		c.Request.URL.RawQuery,
+		"")
+	lookedUpInteraction, success := deps.InteractionLookup.Select(interactionKey, false)
+
+	// The Ruby core can only match JSON request bodies, so binary bodies are converted before being passed on.
+	requestHeaders := c.Request.Header
+	if encoder, encoded := encoders.Lookup(lookedUpInteraction.Request.Encoding); success && encoded && len(requestBytes) > 0 {
+		requestBytes, err = encoder.BinaryToJson(requestBytes, lookedUpInteraction.Request.Encoding, c.Request.URL.Path)
+		if err != nil {
+			return err
+		}
+		requestHeaders = copyHeaders(c.Request.Header)
+		requestHeaders.Set("Content-Type", "application/json")
+		requestHeaders.Set("Content-Length", strconv.Itoa(len(requestBytes)))
+	}
+
+	reader := bytes.NewBuffer(requestBytes)
 	requestBody := ioutil.NopCloser(reader)
 
 	req := &http.Request{
-		URL:    ul,
-		Method: c.Request.Method,
-		Header: c.Request.Header,
-		Body:   requestBody}
+		URL:           ul,
+		Method:        c.Request.Method,
+		Header:        requestHeaders,
+		Body:          requestBody,
+		ContentLength: int64(len(requestBytes))}
 	response, err := deps.HttpClient.Do(req)
 	if err != nil {
 		return err
 	}
 
-	interactionKey := domain.CreateUniqueInteractionIdentifier(
-		strings.ToLower(c.Request.Method),
-		c.Request.URL.Path,
-		c.Request.URL.RawQuery)
-	lookedUpInteraction, success := deps.InteractionLookup.Get(interactionKey)
 	if !success {
 		return errors.New(fmt.Sprintf("Failed to look up interaction: %v", interactionKey))
 	}
@@ -297,38 +461,27 @@ func (deps Dependencies) handleDynamicEndpointsInner(c *gin.Context) error {
 		return err
 	}
 
-	if lookedUpInteraction.Response.Encoding != nil && lookedUpInteraction.Response.Encoding.Type == "protobuf" {
-		msgDescriptor, err := descriptorlogic.GetMessageDescriptorFromBody(lookedUpInteraction.Response.Encoding, c.Request.URL.Path)
-		if err != nil {
-			return err
-		}
-
-		protoJsonResp, err := descriptorlogic.JsonBytesToProtobufBytes(responseJson, msgDescriptor)
+	// The Ruby core has matched the request against the registered interactions, so the status it returns determines
+	// which interaction's response encoding applies. If no interaction has that status (e.g. the core couldn't match
+	// the request) then the core's response is passed through as-is.
+	responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(interactionKey, false, response.StatusCode)
+	if encoder, encoded := encoders.Lookup(responseInteraction.Response.Encoding); success && encoded {
+		encodedResp, err := encoder.JsonToBinary(responseJson, responseInteraction.Response.Encoding, c.Request.URL.Path)
 		if err != nil {
 			return err
 		}
 		c.DataFromReader(
-			lookedUpInteraction.Response.Status, int64(len(protoJsonResp)), "application/octet-stream",
-			bytes.NewReader(protoJsonResp), map[string]string{})
+			response.StatusCode, int64(len(encodedResp)), encoder.ContentType(responseInteraction.Response.Encoding),
+			bytes.NewReader(encodedResp), map[string]string{})
 	} else {
 		c.DataFromReader(
-			lookedUpInteraction.Response.Status, int64(len(responseJson)), "application/json",
+			response.StatusCode, int64(len(responseJson)), "application/json",
 			bytes.NewReader(responseJson), map[string]string{})
 	}
-
-	for k, vArr := range response.Header {
-		for _, v := range vArr {
-			c.Writer.Header().Add(k, v)
-		}
-	}
-
-	c.DataFromReader(response.StatusCode, response.ContentLength,
-		"application/json", response.Body, map[string]string{})
 	return nil
 }
 
 func (deps Dependencies) HandleDynamicEndpoints(c *gin.Context) {
-	// TODO: Support custom serialization of request body
 	err := deps.handleDynamicEndpointsInner(c)
 	if err != nil {
 		_ = c.AbortWithError(500, err)
@@ -354,7 +507,18 @@ func (deps Dependencies) writePactToFileInner(c *gin.Context) error {
 	}
 
 	pactContractHandler.PopulateContractFromInteractions(&contract, deps.InteractionLookup)
+	if deps.CliArgs.PactSpecificationVersion != "" {
+		contract.Metadata.PactSpecification.Version = deps.CliArgs.PactSpecificationVersion
+	}
+	contract.NormaliseForSpecificationVersion()
 
+	return deps.writeContractToFile(c, &contract)
+}
+
+func (deps Dependencies) writeContractToFile(c *gin.Context, contract *serialization.PactContract) error {
+	if !deps.CliArgs.NumericDescriptorSets {
+		contract.CompactFileDescriptorSets()
+	}
 	outputtedJson, err := json.Marshal(contract)
 	if err != nil {
 		return err
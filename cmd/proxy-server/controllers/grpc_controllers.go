@@ -0,0 +1,448 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// The message types of gRPC calls are only known from the registered descriptors, so messages are passed around as raw
+// bytes rather than being decoded by gRPC itself.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	data, isBytes := v.(*[]byte)
+	if !isBytes {
+		return nil, fmt.Errorf("unable to marshal %T as raw bytes", v)
+	}
+	return *data, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	target, isBytes := v.(*[]byte)
+	if !isBytes {
+		return fmt.Errorf("unable to unmarshal raw bytes into %T", v)
+	}
+	// gRPC may reuse the buffer once the message has been received
+	*target = append((*target)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+func (rawCodec) String() string {
+	return rawCodec{}.Name()
+}
+
+// Every gRPC call is handled dynamically, as there are no generated service implementations to register.
+func (deps Dependencies) GrpcServerOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.CustomCodec(rawCodec{}),
+		grpc.UnknownServiceHandler(deps.HandleGrpcCall),
+	}
+}
+
+// Methods which aren't defined in the interaction's descriptors are treated as unary.
+func grpcMethodDescriptor(interaction *serialization.ProviderServiceInteraction, fullMethod string) *desc.MethodDescriptor {
+	for _, encoding := range []*serialization.SerializationEncoding{interaction.Request.Encoding, interaction.Response.Encoding} {
+		if encoding == nil || encoding.Type != "protobuf" {
+			continue
+		}
+		method, err := descriptorlogic.GetMethodDescriptorFromBody(encoding, fullMethod)
+		if err == nil {
+			return method
+		}
+	}
+	return nil
+}
+
+// The descriptors registered with a gRPC interaction may name the message explicitly, otherwise the message is taken
+// from the method's definition in whichever descriptors the interaction carries.
+func grpcMessageDescriptor(interaction *serialization.ProviderServiceInteraction, fullMethod string, request bool) (*desc.MessageDescriptor, error) {
+	encoding := interaction.Response.Encoding
+	if request {
+		encoding = interaction.Request.Encoding
+	}
+	if description := encoding.GetProtobufDescription(); description != nil && description.MessageName != "" {
+		return descriptorlogic.GetMessageDescriptorFromBody(encoding, fullMethod)
+	}
+
+	method := grpcMethodDescriptor(interaction, fullMethod)
+	if method == nil {
+		return nil, fmt.Errorf("no protobuf descriptors registered for gRPC method %s", fullMethod)
+	}
+	if request {
+		return method.GetInputType(), nil
+	}
+	return method.GetOutputType(), nil
+}
+
+// Metadata sent by the consumer is passed to the Ruby core as headers, so that it can be matched like any other header.
+func headersFromIncomingMetadata(ctx context.Context) http.Header {
+	headers := http.Header{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for k, vArr := range md {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || strings.HasSuffix(k, "-bin") ||
+			k == "content-type" || k == "user-agent" || k == "te" {
+			continue
+		}
+		for _, v := range vArr {
+			headers.Add(k, v)
+		}
+	}
+	return headers
+}
+
+// Consumer side: a call to "/package.Service/Method" is matched to the interaction registered for a POST to that path,
+// and is passed to the Ruby core as JSON in the same way as an HTTP request. The Ruby core's status is mapped to a gRPC
+// status, with the core's response body as the status message where the call didn't succeed. Streamed messages are
+// gathered into (or sent from) a JSON array.
+func (deps Dependencies) callRubyCoreForRpc(fullMethod string, headers http.Header, requestMessages [][]byte) ([][]byte, *status.Status, error) {
+	interactionKey := domain.CreateUniqueInteractionIdentifier("post", fullMethod, "", "")
+	lookedUpInteraction, success := deps.InteractionLookup.Select(interactionKey, false)
+	if !success {
+		return nil, status.Newf(codes.Unimplemented, "Failed to look up interaction: %v", interactionKey), nil
+	}
+	method := grpcMethodDescriptor(&lookedUpInteraction, fullMethod)
+	clientStreaming := method != nil && method.IsClientStreaming()
+	serverStreaming := method != nil && method.IsServerStreaming()
+	if !clientStreaming && len(requestMessages) != 1 {
+		return nil, status.Newf(codes.InvalidArgument, "expected a single request message for %s", fullMethod), nil
+	}
+
+	requestDescriptor, err := grpcMessageDescriptor(&lookedUpInteraction, fullMethod, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	requestJsonMessages := make([]json.RawMessage, 0, len(requestMessages))
+	for _, requestBytes := range requestMessages {
+		requestJson, err := descriptorlogic.ProtobufBytesToJsonBytes(requestBytes, requestDescriptor)
+		if err != nil {
+			return nil, nil, err
+		}
+		requestJsonMessages = append(requestJsonMessages, requestJson)
+	}
+	// A client stream may have no messages at all, which is sent as an empty array
+	var requestJson []byte
+	if clientStreaming {
+		requestJson, err = json.Marshal(requestJsonMessages)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		requestJson = requestJsonMessages[0]
+	}
+
+	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + strings.TrimLeft(fullMethod, "/"))
+	if err != nil {
+		return nil, nil, err
+	}
+	requestHeaders := copyHeaders(headers)
+	requestHeaders.Set("Content-Type", "application/json")
+	req := &http.Request{
+		URL:           ul,
+		Method:        "POST",
+		Header:        requestHeaders,
+		Body:          ioutil.NopCloser(bytes.NewReader(requestJson)),
+		ContentLength: int64(len(requestJson))}
+	response, err := deps.HttpClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	responseJson, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	code := domain.GrpcCodeFromHttpStatus(response.StatusCode)
+	if code != codes.OK {
+		return nil, status.New(code, string(responseJson)), nil
+	}
+
+	responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(interactionKey, false, response.StatusCode)
+	if !success {
+		responseInteraction = lookedUpInteraction
+	}
+	responseDescriptor, err := grpcMessageDescriptor(&responseInteraction, fullMethod, false)
+	if err != nil {
+		return nil, nil, err
+	}
+	responseJsonMessages := []json.RawMessage{responseJson}
+	if serverStreaming {
+		responseJsonMessages, err = serialization.CreatePactRequestBody(string(responseJson)).GetStreamedMessages()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	responseMessages := make([][]byte, 0, len(responseJsonMessages))
+	for _, responseMessage := range responseJsonMessages {
+		responseBytes, err := descriptorlogic.JsonBytesToProtobufBytes(responseMessage, responseDescriptor)
+		if err != nil {
+			return nil, nil, err
+		}
+		responseMessages = append(responseMessages, responseBytes)
+	}
+	return responseMessages, status.New(codes.OK, ""), nil
+}
+
+func (deps Dependencies) handleGrpcCallInner(stream grpc.ServerStream) error {
+	fullMethod, success := grpc.MethodFromServerStream(stream)
+	if !success {
+		return status.Error(codes.Internal, "unable to determine the gRPC method being called")
+	}
+
+	// The client half-closes the stream after its last message, whether or not the method is client-streaming
+	requestMessages := make([][]byte, 0, 1)
+	for {
+		var requestBytes []byte
+		err := stream.RecvMsg(&requestBytes)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		requestMessages = append(requestMessages, requestBytes)
+	}
+
+	responseMessages, callStatus, err := deps.callRubyCoreForRpc(fullMethod, headersFromIncomingMetadata(stream.Context()), requestMessages)
+	if err != nil {
+		return err
+	}
+	for i := range responseMessages {
+		err = stream.SendMsg(&responseMessages[i])
+		if err != nil {
+			return err
+		}
+	}
+	return callStatus.Err()
+}
+
+func (deps Dependencies) HandleGrpcCall(srv interface{}, stream grpc.ServerStream) error {
+	err := deps.handleGrpcCallInner(stream)
+	if err != nil {
+		fmt.Println(err)
+		if _, isStatus := status.FromError(err); !isStatus {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+	return err
+}
+
+// An interaction is verified over gRPC where it's a POST to a method defined in the interaction's protobuf descriptors.
+func isGrpcInteraction(interaction *serialization.ProviderServiceInteraction) bool {
+	if !strings.EqualFold(interaction.Request.Method, "post") || interaction.Request.Path == nil {
+		return false
+	}
+	return grpcMethodDescriptor(interaction, interaction.Request.Path.GetString()) != nil
+}
+
+func (deps Dependencies) grpcProviderCredentials() (grpc.DialOption, error) {
+	if !deps.CliArgs.GrpcProviderTls {
+		return grpc.WithInsecure(), nil
+	}
+	if deps.CliArgs.GrpcProviderCaCert != "" {
+		creds, err := credentials.NewClientTLSFromFile(deps.CliArgs.GrpcProviderCaCert, "")
+		if err != nil {
+			return nil, err
+		}
+		return grpc.WithTransportCredentials(creds), nil
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{})), nil
+}
+
+// Headers sent by the Ruby verifier are passed to the provider as metadata, apart from those describing the HTTP request.
+func metadataFromHeaders(headers http.Header) metadata.MD {
+	md := metadata.MD{}
+	for k, vArr := range headers {
+		switch strings.ToLower(k) {
+		case "content-type", "content-length", "accept", "accept-encoding", "user-agent", "host", "connection", "te":
+			continue
+		}
+		md.Append(k, vArr...)
+	}
+	return md
+}
+
+// The gRPC status and any metadata returned by the provider are reported as headers, so they can be asserted on by the
+// interaction like any other header.
+func writeMetadataAsHeaders(c *gin.Context, md metadata.MD) {
+	for k, vArr := range md {
+		if strings.HasSuffix(k, "-bin") {
+			continue
+		}
+		for _, v := range vArr {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+}
+
+// The Ruby verifier sends the request body as JSON, which is encoded as the method's request message(s).
+func encodeRpcRequest(interaction *serialization.ProviderServiceInteraction, fullMethod string, reqBody []byte) ([][]byte, error) {
+	requestDescriptor, err := grpcMessageDescriptor(interaction, fullMethod, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(reqBody) == 0 {
+		reqBody = []byte("{}")
+	}
+	requestJsonMessages := []json.RawMessage{reqBody}
+	if method := grpcMethodDescriptor(interaction, fullMethod); method != nil && method.IsClientStreaming() {
+		requestJsonMessages, err = serialization.CreatePactRequestBody(string(reqBody)).GetStreamedMessages()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	requestMessages := make([][]byte, 0, len(requestJsonMessages))
+	for _, requestJson := range requestJsonMessages {
+		requestBytes, err := descriptorlogic.JsonBytesToProtobufBytes(requestJson, requestDescriptor)
+		if err != nil {
+			return nil, err
+		}
+		requestMessages = append(requestMessages, requestBytes)
+	}
+	return requestMessages, nil
+}
+
+// The provider's reply is decoded to JSON for the Ruby verifier. The gRPC status is mapped to an HTTP status, with the
+// status message as the body where the call didn't succeed, and streamed messages are gathered into a JSON array so
+// that the stream is compared message by message.
+func (deps Dependencies) writeRpcVerificationResponse(
+	c *gin.Context, interactionKey domain.UniqueInteractionIdentifier, providerStateKnown bool,
+	lookedUpInteraction serialization.ProviderServiceInteraction, fullMethod string, callStatus *status.Status,
+	responseMessages [][]byte) error {
+	c.Writer.Header().Set("Grpc-Status", strconv.Itoa(int(callStatus.Code())))
+	httpStatus := domain.HttpStatusFromGrpcCode(callStatus.Code())
+	if callStatus.Code() != codes.OK {
+		c.Writer.Header().Set("Grpc-Message", callStatus.Message())
+		c.Data(httpStatus, "text/plain; charset=utf-8", []byte(callStatus.Message()))
+		return nil
+	}
+
+	responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(interactionKey, providerStateKnown, httpStatus)
+	if !success {
+		responseInteraction = lookedUpInteraction
+	}
+	responseDescriptor, err := grpcMessageDescriptor(&responseInteraction, fullMethod, false)
+	if err != nil {
+		return err
+	}
+	decodedMessages := make([]json.RawMessage, 0, len(responseMessages))
+	for _, responseBytes := range responseMessages {
+		responseJson, err := descriptorlogic.ProtobufBytesToJsonBytes(responseBytes, responseDescriptor)
+		if err != nil {
+			return err
+		}
+		decodedMessages = append(decodedMessages, responseJson)
+	}
+	var responseJson []byte
+	if method := grpcMethodDescriptor(&responseInteraction, fullMethod); method != nil && method.IsServerStreaming() {
+		responseJson, err = json.Marshal(decodedMessages)
+		if err != nil {
+			return err
+		}
+	} else if len(decodedMessages) == 1 {
+		responseJson = decodedMessages[0]
+	}
+
+	if success {
+		err := reportBodyMismatches(c, responseInteraction.Description,
+			responseInteraction.Response.Body, responseJson, responseInteraction.Response.MatchingRules, responseDescriptor)
+		if err != nil {
+			return err
+		}
+	}
+	c.Data(httpStatus, "application/json", responseJson)
+	return nil
+}
+
+// Provider side: the request is sent to the provider over gRPC.
+func (deps Dependencies) handleGrpcVerificationInner(
+	c *gin.Context, reqBody []byte, interactionKey domain.UniqueInteractionIdentifier, providerStateKnown bool,
+	lookedUpInteraction serialization.ProviderServiceInteraction) error {
+	fullMethod := "/" + strings.TrimLeft(c.Request.URL.Path, "/")
+	method := grpcMethodDescriptor(&lookedUpInteraction, fullMethod)
+	streamDescription := &grpc.StreamDesc{
+		StreamName:    method.GetName(),
+		ClientStreams: method.IsClientStreaming(),
+		ServerStreams: method.IsServerStreaming(),
+	}
+	requestMessages, err := encodeRpcRequest(&lookedUpInteraction, fullMethod, reqBody)
+	if err != nil {
+		return err
+	}
+
+	credentialsOption, err := deps.grpcProviderCredentials()
+	if err != nil {
+		return err
+	}
+	conn, err := deps.GrpcDialer(deps.CliArgs.GrpcProviderAddress, credentialsOption)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := metadata.NewOutgoingContext(c.Request.Context(), metadataFromHeaders(deps.providerRequestHeaders(c)))
+	stream, err := conn.NewStream(ctx, streamDescription, fullMethod, grpc.CallCustomCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+	for i := range requestMessages {
+		// Failures are reported by RecvMsg below
+		if err = stream.SendMsg(&requestMessages[i]); err != nil {
+			break
+		}
+	}
+	err = stream.CloseSend()
+	if err != nil {
+		return err
+	}
+
+	responseMessages := make([][]byte, 0, 1)
+	for {
+		var responseBytes []byte
+		err = stream.RecvMsg(&responseBytes)
+		if err != nil {
+			break
+		}
+		responseMessages = append(responseMessages, responseBytes)
+		if !streamDescription.ServerStreams {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	callStatus, isStatus := status.FromError(err)
+	if !isStatus {
+		return err
+	}
+
+	header, _ := stream.Header()
+	writeMetadataAsHeaders(c, header)
+	writeMetadataAsHeaders(c, stream.Trailer())
+	return deps.writeRpcVerificationResponse(
+		c, interactionKey, providerStateKnown, lookedUpInteraction, fullMethod, callStatus, responseMessages)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+)
+
+// Collects the descriptors of the messages used by the contract's interactions and messages, keyed by full name.
+func (deps Dependencies) contractMessageDescriptors(contract *serialization.PactContract) map[string]*desc.MessageDescriptor {
+	descriptors := map[string]*desc.MessageDescriptor{}
+	for i := range contract.Interactions {
+		interaction := &contract.Interactions[i]
+		if interaction.Request.Path == nil {
+			continue
+		}
+		fullMethod := interaction.Request.Path.GetString()
+		if twirpMethod, isTwirp := deps.twirpMethod(fullMethod); isTwirp {
+			fullMethod = twirpMethod
+		}
+		for _, request := range []bool{true, false} {
+			encoding := interaction.Response.Encoding
+			if request {
+				encoding = interaction.Request.Encoding
+			}
+			// Only protobuf bodies have descriptors, unless the body is a message of a gRPC method
+			if (encoding == nil || encoding.Type != "protobuf") && grpcMethodDescriptor(interaction, fullMethod) == nil {
+				continue
+			}
+			messageDescriptor, err := grpcMessageDescriptor(interaction, fullMethod, request)
+			if err == nil {
+				descriptors[messageDescriptor.GetFullyQualifiedName()] = messageDescriptor
+			}
+		}
+	}
+	for _, message := range contract.Messages {
+		if message.Encoding == nil || message.Encoding.Type != "protobuf" {
+			continue
+		}
+		messageDescriptor, err := descriptorlogic.GetMessageDescriptorFromBody(message.Encoding, message.Description)
+		if err == nil {
+			descriptors[messageDescriptor.GetFullyQualifiedName()] = messageDescriptor
+		}
+	}
+	return descriptors
+}
+
+// Fetches the provider's current descriptors over gRPC server reflection, and compares each message used by the
+// contract with the provider's definition of it.
+func (deps Dependencies) CompareProviderDescriptors(contract *serialization.PactContract) ([]descriptorlogic.DescriptorDifference, error) {
+	credentialsOption, err := deps.grpcProviderCredentials()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := deps.GrpcDialer(deps.CliArgs.GrpcProviderAddress, credentialsOption)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := grpcreflect.NewClient(context.Background(), rpb.NewServerReflectionClient(conn))
+	defer client.Reset()
+
+	contractDescriptors := deps.contractMessageDescriptors(contract)
+	names := make([]string, 0, len(contractDescriptors))
+	for name := range contractDescriptors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	differences := make([]descriptorlogic.DescriptorDifference, 0)
+	for _, name := range names {
+		providerDescriptor, err := client.ResolveMessage(name)
+		if grpcreflect.IsElementNotFoundError(err) {
+			differences = append(differences, descriptorlogic.DescriptorDifference{
+				MessageName: name,
+				Description: "message not found on the provider",
+			})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch the provider's descriptor for %s: %v", name, err)
+		}
+		differences = append(differences, descriptorlogic.CompareMessageDescriptors(contractDescriptors[name], providerDescriptor)...)
+	}
+	return differences, nil
+}
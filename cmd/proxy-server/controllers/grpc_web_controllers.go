@@ -0,0 +1,295 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcWebContentType = "application/grpc-web+proto"
+	connectContentType = "application/connect+proto"
+)
+
+// Both gRPC-Web and the Connect streaming protocol carry each message in an envelope: a flags byte followed by the
+// big-endian length of the message. The last envelope of a response carries the status of the call, rather than a
+// message.
+const (
+	envelopeHeaderLength   = 5
+	envelopeCompressedFlag = 0x01
+	connectEndStreamFlag   = 0x02
+	grpcWebTrailerFlag     = 0x80
+)
+
+type envelope struct {
+	flags byte
+	data  []byte
+}
+
+// Returns the content type of the protocol in use, or "" if the request isn't gRPC-Web or Connect.
+func framedRpcProtocol(contentType string) string {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	switch mediaType {
+	case grpcWebContentType, "application/grpc-web":
+		return grpcWebContentType
+	case connectContentType:
+		return connectContentType
+	}
+	return ""
+}
+
+func frameEnvelope(flags byte, data []byte) []byte {
+	framed := make([]byte, envelopeHeaderLength, envelopeHeaderLength+len(data))
+	framed[0] = flags
+	binary.BigEndian.PutUint32(framed[1:], uint32(len(data)))
+	return append(framed, data...)
+}
+
+func unframeEnvelopes(body []byte) ([]envelope, error) {
+	envelopes := make([]envelope, 0, 2)
+	for len(body) > 0 {
+		if len(body) < envelopeHeaderLength {
+			return nil, errors.New("truncated envelope header")
+		}
+		length := int(binary.BigEndian.Uint32(body[1:envelopeHeaderLength]))
+		if len(body)-envelopeHeaderLength < length {
+			return nil, errors.New("truncated envelope")
+		}
+		if body[0]&envelopeCompressedFlag != 0 {
+			return nil, errors.New("compressed messages are not supported")
+		}
+		envelopes = append(envelopes, envelope{flags: body[0], data: body[envelopeHeaderLength : envelopeHeaderLength+length]})
+		body = body[envelopeHeaderLength+length:]
+	}
+	return envelopes, nil
+}
+
+func isEndOfStream(protocol string, flags byte) bool {
+	if protocol == connectContentType {
+		return flags&connectEndStreamFlag != 0
+	}
+	return flags&grpcWebTrailerFlag != 0
+}
+
+// Connect names status codes in snake case, e.g. "not_found" for codes.NotFound.
+func connectCodeName(code codes.Code) string {
+	var builder strings.Builder
+	for i, r := range code.String() {
+		if unicode.IsUpper(r) && i > 0 {
+			builder.WriteRune('_')
+		}
+		builder.WriteRune(unicode.ToLower(r))
+	}
+	return builder.String()
+}
+
+func connectCodeFromName(name string) codes.Code {
+	for code := codes.Canceled; code <= codes.Unauthenticated; code++ {
+		if connectCodeName(code) == name {
+			return code
+		}
+	}
+	return codes.Unknown
+}
+
+type connectError struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type connectEndStream struct {
+	Error    *connectError       `json:"error,omitempty"`
+	Metadata map[string][]string `json:"metadata,omitempty"`
+}
+
+func endOfStreamEnvelope(protocol string, callStatus *status.Status) ([]byte, error) {
+	if protocol == connectContentType {
+		endStream := connectEndStream{}
+		if callStatus.Code() != codes.OK {
+			endStream.Error = &connectError{Code: connectCodeName(callStatus.Code()), Message: callStatus.Message()}
+		}
+		data, err := json.Marshal(endStream)
+		if err != nil {
+			return nil, err
+		}
+		return frameEnvelope(connectEndStreamFlag, data), nil
+	}
+
+	trailer := fmt.Sprintf("grpc-status: %d\r\n", callStatus.Code())
+	if callStatus.Message() != "" {
+		trailer += "grpc-message: " + url.PathEscape(callStatus.Message()) + "\r\n"
+	}
+	return frameEnvelope(grpcWebTrailerFlag, []byte(trailer)), nil
+}
+
+// gRPC-Web trailers are formatted as HTTP/1 headers, whereas Connect sends a JSON object.
+func parseEndOfStream(protocol string, data []byte) (metadata.MD, *status.Status, error) {
+	if protocol == connectContentType {
+		endStream := connectEndStream{}
+		err := json.Unmarshal(data, &endStream)
+		if err != nil {
+			return nil, nil, err
+		}
+		md := metadata.MD{}
+		for k, vArr := range endStream.Metadata {
+			md.Append(k, vArr...)
+		}
+		if endStream.Error == nil {
+			return md, status.New(codes.OK, ""), nil
+		}
+		return md, status.New(connectCodeFromName(endStream.Error.Code), endStream.Error.Message), nil
+	}
+
+	md := metadata.MD{}
+	for _, line := range strings.Split(string(data), "\r\n") {
+		keyAndValue := strings.SplitN(line, ":", 2)
+		if len(keyAndValue) == 2 {
+			md.Append(strings.TrimSpace(keyAndValue[0]), strings.TrimSpace(keyAndValue[1]))
+		}
+	}
+	return md, grpcWebStatusFromMetadata(md), nil
+}
+
+func grpcWebStatusFromMetadata(md metadata.MD) *status.Status {
+	codeValues := md.Get("grpc-status")
+	if len(codeValues) == 0 {
+		return status.New(codes.OK, "")
+	}
+	code, err := strconv.Atoi(codeValues[0])
+	if err != nil {
+		return status.New(codes.Unknown, "invalid grpc-status: "+codeValues[0])
+	}
+	message := ""
+	if messageValues := md.Get("grpc-message"); len(messageValues) > 0 {
+		message, err = url.PathUnescape(messageValues[0])
+		if err != nil {
+			message = messageValues[0]
+		}
+	}
+	return status.New(codes.Code(code), message)
+}
+
+// Consumer side: gRPC-Web and Connect calls are taken out of their envelopes and passed to the Ruby core in the same way
+// as native gRPC calls, with the response messages and status put into envelopes in turn.
+func (deps Dependencies) handleFramedRpcInner(c *gin.Context, protocol string) error {
+	requestBody, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	envelopes, err := unframeEnvelopes(requestBody)
+	if err != nil {
+		return err
+	}
+	requestMessages := make([][]byte, 0, len(envelopes))
+	for _, requestEnvelope := range envelopes {
+		if !isEndOfStream(protocol, requestEnvelope.flags) {
+			requestMessages = append(requestMessages, requestEnvelope.data)
+		}
+	}
+
+	requestHeaders := copyHeaders(c.Request.Header)
+	requestHeaders.Del("Content-Length")
+	responseMessages, callStatus, err := deps.callRubyCoreForRpc(c.Request.URL.Path, requestHeaders, requestMessages)
+	if err != nil {
+		return err
+	}
+
+	responseBody := new(bytes.Buffer)
+	for _, responseMessage := range responseMessages {
+		responseBody.Write(frameEnvelope(0, responseMessage))
+	}
+	endOfStream, err := endOfStreamEnvelope(protocol, callStatus)
+	if err != nil {
+		return err
+	}
+	responseBody.Write(endOfStream)
+
+	// Both protocols report the status of the call in the body, rather than through the HTTP status
+	c.Data(http.StatusOK, protocol, responseBody.Bytes())
+	return nil
+}
+
+// Provider side: the request is sent to the provider in the envelopes of its protocol, with the status of the call taken
+// from the last envelope of the response (or from the headers, for a gRPC-Web response without a body).
+func (deps Dependencies) handleFramedRpcVerificationInner(
+	c *gin.Context, reqBody []byte, interactionKey domain.UniqueInteractionIdentifier, providerStateKnown bool,
+	lookedUpInteraction serialization.ProviderServiceInteraction, protocol string) error {
+	fullMethod := "/" + strings.TrimLeft(c.Request.URL.Path, "/")
+	requestMessages, err := encodeRpcRequest(&lookedUpInteraction, fullMethod, reqBody)
+	if err != nil {
+		return err
+	}
+	requestBody := new(bytes.Buffer)
+	for _, requestMessage := range requestMessages {
+		requestBody.Write(frameEnvelope(0, requestMessage))
+	}
+
+	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + strings.TrimLeft(c.Request.URL.RequestURI(), "/"))
+	if err != nil {
+		return err
+	}
+	requestHeaders := deps.providerRequestHeaders(c)
+	requestHeaders.Set("Content-Type", protocol)
+	requestHeaders.Set("Content-Length", strconv.Itoa(requestBody.Len()))
+	req := &http.Request{
+		URL:           ul,
+		Method:        "POST",
+		Header:        requestHeaders,
+		Body:          ioutil.NopCloser(requestBody),
+		ContentLength: int64(requestBody.Len())}
+	response, err := deps.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	responseHeaders := metadataFromHeaders(response.Header)
+	writeMetadataAsHeaders(c, responseHeaders)
+	if response.StatusCode != http.StatusOK {
+		callStatus := status.New(domain.GrpcCodeFromHttpStatus(response.StatusCode), string(responseBody))
+		return deps.writeRpcVerificationResponse(
+			c, interactionKey, providerStateKnown, lookedUpInteraction, fullMethod, callStatus, nil)
+	}
+
+	envelopes, err := unframeEnvelopes(responseBody)
+	if err != nil {
+		return err
+	}
+	callStatus := status.New(codes.OK, "")
+	if protocol == grpcWebContentType {
+		callStatus = grpcWebStatusFromMetadata(responseHeaders)
+	}
+	responseMessages := make([][]byte, 0, len(envelopes))
+	for _, responseEnvelope := range envelopes {
+		if !isEndOfStream(protocol, responseEnvelope.flags) {
+			responseMessages = append(responseMessages, responseEnvelope.data)
+			continue
+		}
+		var trailer metadata.MD
+		trailer, callStatus, err = parseEndOfStream(protocol, responseEnvelope.data)
+		if err != nil {
+			return err
+		}
+		writeMetadataAsHeaders(c, trailer)
+	}
+	return deps.writeRpcVerificationResponse(
+		c, interactionKey, providerStateKnown, lookedUpInteraction, fullMethod, callStatus, responseMessages)
+}
@@ -0,0 +1,196 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/encoders"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/matching"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// The body which the Ruby verifier sends to the provider, asking it to produce a message.
+type messageProductionRequest struct {
+	Description    string                        `json:"description"`
+	ProviderState  string                        `json:"providerState"`
+	ProviderStates []serialization.ProviderState `json:"providerStates"`
+}
+
+// Consumer side: the message is recorded for the pact, and the message is returned in its encoded form, ready to be
+// passed to the consumer's message handler.
+func (deps Dependencies) handleMessageAddInner(c *gin.Context) error {
+	jsonBytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	message := serialization.MessageInteraction{}
+	err = json.Unmarshal(jsonBytes, &message)
+	if err != nil {
+		return err
+	}
+	if message.Contents == nil {
+		return errors.New("message has no contents: " + message.Description)
+	}
+	encodings := []*serialization.SerializationEncoding{message.Encoding}
+	if message.Request != nil {
+		encodings = append(encodings, message.Request.Encoding)
+	}
+	for _, response := range message.Response {
+		encodings = append(encodings, response.Encoding)
+	}
+	err = deps.resolveEncodingDescriptors(message.Description, encodings...)
+	if err != nil {
+		c.String(http.StatusBadRequest, err.Error())
+		return nil
+	}
+
+	example, rules, err := matching.Reify([]byte(message.Contents.GetString()))
+	if err != nil {
+		return err
+	}
+	message.Contents = serialization.CreatePactRequestBody(string(example))
+	if message.MatchingRules == nil && rules != nil {
+		message.MatchingRules = rules
+	}
+
+	err = deps.MessageLookup.Add(message)
+	if err != nil {
+		fmt.Printf("Unable to add message: %v\n", err)
+	}
+
+	if encoder, encoded := encoders.Lookup(message.Encoding); encoded {
+		messageBytes, err := encoder.JsonToBinary(example, message.Encoding, message.Description)
+		if err != nil {
+			return err
+		}
+		c.Data(200, encoder.ContentType(message.Encoding), messageBytes)
+		return nil
+	}
+	c.Data(200, "application/json", example)
+	return nil
+}
+
+func (deps Dependencies) HandleMessageAdd(c *gin.Context) {
+	err := deps.handleMessageAddInner(c)
+	if err != nil {
+		_ = c.AbortWithError(500, err)
+	}
+}
+
+// There's no Ruby core involved in writing message pacts, so the contract is built entirely from the recorded messages.
+func (deps Dependencies) writeMessagePactToFileInner(c *gin.Context) error {
+	contract := serialization.PactContract{
+		Consumer: serialization.ConsumerOrProvider{Name: deps.CliArgs.Consumer},
+		Provider: serialization.ConsumerOrProvider{Name: deps.CliArgs.Provider},
+		Messages: deps.MessageLookup.GetAll(),
+		Metadata: serialization.PactContractMetadata{
+			PactSpecification: serialization.PactSpecificationDescription{Version: serialization.PactSpecificationV3},
+		},
+	}
+	if deps.CliArgs.PactSpecificationVersion != "" {
+		contract.Metadata.PactSpecification.Version = deps.CliArgs.PactSpecificationVersion
+	}
+	contract.NormaliseForSpecificationVersion()
+
+	return deps.writeContractToFile(c, &contract)
+}
+
+func (deps Dependencies) WriteMessagePactToFile(c *gin.Context) {
+	err := deps.writeMessagePactToFileInner(c)
+	if err != nil {
+		_ = c.AbortWithError(500, err)
+	}
+}
+
+// Provider side: the Ruby verifier's request is passed on to the provider's message-producer endpoint, and the encoded
+// message it returns is decoded to JSON for the verifier.
+func (deps Dependencies) handleVerificationMessagesInner(c *gin.Context) error {
+	reqBody, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+	productionRequest := messageProductionRequest{}
+	err = json.Unmarshal(reqBody, &productionRequest)
+	if err != nil {
+		return err
+	}
+
+	providerState, providerStateKnown := deps.providerStateFromRequest(c)
+	if !providerStateKnown && (productionRequest.ProviderState != "" || len(productionRequest.ProviderStates) > 0) {
+		providerState = (&serialization.MessageInteraction{
+			ProviderState:  productionRequest.ProviderState,
+			ProviderStates: productionRequest.ProviderStates,
+		}).GetProviderState()
+		providerStateKnown = true
+	}
+	message, success := deps.MessageLookup.Get(productionRequest.Description, providerState, providerStateKnown)
+	if !success {
+		return errors.New(fmt.Sprintf("Failed to look up message: %s", productionRequest.Description))
+	}
+
+	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + strings.TrimLeft(c.Request.URL.RequestURI(), "/"))
+	if err != nil {
+		return err
+	}
+	req := &http.Request{
+		URL:           ul,
+		Method:        c.Request.Method,
+		Header:        deps.providerRequestHeaders(c),
+		Body:          ioutil.NopCloser(bytes.NewReader(reqBody)),
+		ContentLength: int64(len(reqBody))}
+	response, err := deps.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	messageBytes, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	contentType := strings.Join(response.Header["Content-Type"], "; ")
+	if encoder, encoded := encoders.Lookup(message.Encoding); encoded {
+		messageBytes, err = encoder.BinaryToJson(messageBytes, message.Encoding, message.Description)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+
+		msgDescriptor, err := encoders.MessageDescriptor(encoder, message.Encoding, message.Description)
+		if err != nil {
+			return err
+		}
+
+		err = reportBodyMismatches(
+			c, message.Description, message.Contents, messageBytes, message.MatchingRules, msgDescriptor)
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, vArr := range response.Header {
+		if strings.EqualFold(k, "Content-Type") || strings.EqualFold(k, "Content-Length") {
+			continue
+		}
+		for _, v := range vArr {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Data(response.StatusCode, contentType, messageBytes)
+	return nil
+}
+
+func (deps Dependencies) HandleVerificationMessages(c *gin.Context) {
+	err := deps.handleVerificationMessagesInner(c)
+	if err != nil {
+		fmt.Println(err)
+		_ = c.AbortWithError(500, err)
+	}
+}
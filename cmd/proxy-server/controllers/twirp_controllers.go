@@ -0,0 +1,262 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Twirp errors are always JSON, whichever encoding the request used.
+type twirpError struct {
+	Code string            `json:"code"`
+	Msg  string            `json:"msg"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+var twirpCodeToHttpStatus = map[string]int{
+	"canceled":            http.StatusRequestTimeout,
+	"unknown":             http.StatusInternalServerError,
+	"invalid_argument":    http.StatusBadRequest,
+	"malformed":           http.StatusBadRequest,
+	"deadline_exceeded":   http.StatusRequestTimeout,
+	"not_found":           http.StatusNotFound,
+	"bad_route":           http.StatusNotFound,
+	"already_exists":      http.StatusConflict,
+	"permission_denied":   http.StatusForbidden,
+	"unauthenticated":     http.StatusUnauthorized,
+	"resource_exhausted":  http.StatusTooManyRequests,
+	"failed_precondition": http.StatusPreconditionFailed,
+	"aborted":             http.StatusConflict,
+	"out_of_range":        http.StatusBadRequest,
+	"unimplemented":       http.StatusNotImplemented,
+	"internal":            http.StatusInternalServerError,
+	"unavailable":         http.StatusServiceUnavailable,
+	"dataloss":            http.StatusInternalServerError,
+}
+
+// Where several codes share an HTTP status, the most general code is chosen.
+var httpStatusToTwirpCode = map[int]string{
+	http.StatusBadRequest:          "invalid_argument",
+	http.StatusUnauthorized:        "unauthenticated",
+	http.StatusForbidden:           "permission_denied",
+	http.StatusNotFound:            "not_found",
+	http.StatusRequestTimeout:      "deadline_exceeded",
+	http.StatusConflict:            "already_exists",
+	http.StatusPreconditionFailed:  "failed_precondition",
+	http.StatusTooManyRequests:     "resource_exhausted",
+	http.StatusInternalServerError: "internal",
+	http.StatusNotImplemented:      "unimplemented",
+	http.StatusServiceUnavailable:  "unavailable",
+}
+
+// An error response which is already a Twirp error is left as it is, otherwise the response is described by a Twirp
+// error with a code matching its status, so that errors can be given in a contract by status alone.
+func twirpErrorBody(status int, body []byte) ([]byte, error) {
+	existing := twirpError{}
+	if json.Unmarshal(body, &existing) == nil && existing.Code != "" {
+		return body, nil
+	}
+
+	code, present := httpStatusToTwirpCode[status]
+	if !present {
+		code = "unknown"
+	}
+	return json.Marshal(twirpError{Code: code, Msg: string(body)})
+}
+
+func writeTwirpError(c *gin.Context, code string, msg string) {
+	status, present := twirpCodeToHttpStatus[code]
+	if !present {
+		status = http.StatusInternalServerError
+	}
+	body, _ := json.Marshal(twirpError{Code: code, Msg: msg})
+	c.Data(status, "application/json", body)
+}
+
+// Returns the method being called as "/package.Service/Method" if the path is a Twirp route.
+func (deps Dependencies) twirpMethod(path string) (string, bool) {
+	if !deps.CliArgs.Twirp {
+		return "", false
+	}
+	prefix := "/" + strings.Trim(deps.CliArgs.TwirpPrefix, "/")
+	if prefix != "/" {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(path, prefix) {
+		return "", false
+	}
+	return "/" + strings.TrimPrefix(path, prefix), true
+}
+
+func isTwirpProtobuf(contentType string) bool {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0])) == "application/protobuf"
+}
+
+// Consumer side: Twirp requests are passed to the Ruby core as JSON, with the request and response messages taken
+// from the method's definition in the interaction's descriptors. The response is encoded in the same way as the
+// request was.
+func (deps Dependencies) handleTwirpInner(c *gin.Context, fullMethod string) error {
+	requestBytes, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		return err
+	}
+
+	interactionKey := domain.CreateUniqueInteractionIdentifier("post", c.Request.URL.Path, c.Request.URL.RawQuery, "")
+	lookedUpInteraction, success := deps.InteractionLookup.Select(interactionKey, false)
+	if !success {
+		writeTwirpError(c, "bad_route", fmt.Sprintf("Failed to look up interaction: %v", interactionKey))
+		return nil
+	}
+
+	protobufRequested := isTwirpProtobuf(c.GetHeader("Content-Type"))
+	requestHeaders := c.Request.Header
+	if protobufRequested {
+		msgDescriptor, err := grpcMessageDescriptor(&lookedUpInteraction, fullMethod, true)
+		if err != nil {
+			return err
+		}
+		requestBytes, err = descriptorlogic.ProtobufBytesToJsonBytes(requestBytes, msgDescriptor)
+		if err != nil {
+			writeTwirpError(c, "malformed", err.Error())
+			return nil
+		}
+		requestHeaders = copyHeaders(c.Request.Header)
+		requestHeaders.Set("Content-Type", "application/json")
+		requestHeaders.Set("Content-Length", strconv.Itoa(len(requestBytes)))
+	}
+
+	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + strings.TrimLeft(c.Request.URL.RequestURI(), "/"))
+	if err != nil {
+		return err
+	}
+	req := &http.Request{
+		URL:           ul,
+		Method:        "POST",
+		Header:        requestHeaders,
+		Body:          ioutil.NopCloser(bytes.NewReader(requestBytes)),
+		ContentLength: int64(len(requestBytes))}
+	response, err := deps.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	responseJson, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		errorBody, err := twirpErrorBody(response.StatusCode, responseJson)
+		if err != nil {
+			return err
+		}
+		c.Data(response.StatusCode, "application/json", errorBody)
+		return nil
+	}
+	if !protobufRequested {
+		c.Data(response.StatusCode, "application/json", responseJson)
+		return nil
+	}
+
+	responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(interactionKey, false, response.StatusCode)
+	if !success {
+		responseInteraction = lookedUpInteraction
+	}
+	msgDescriptor, err := grpcMessageDescriptor(&responseInteraction, fullMethod, false)
+	if err != nil {
+		return err
+	}
+	responseBytes, err := descriptorlogic.JsonBytesToProtobufBytes(responseJson, msgDescriptor)
+	if err != nil {
+		return err
+	}
+	c.Data(response.StatusCode, "application/protobuf", responseBytes)
+	return nil
+}
+
+// Provider side: the request is encoded as the Ruby verifier asked for it (as the consumer did), and a protobuf response
+// is decoded to JSON for the verifier. Twirp errors are passed back as they are.
+func (deps Dependencies) handleTwirpVerificationInner(
+	c *gin.Context, reqBody []byte, interactionKey domain.UniqueInteractionIdentifier, providerStateKnown bool,
+	lookedUpInteraction serialization.ProviderServiceInteraction, fullMethod string) error {
+	requestHeaders := deps.providerRequestHeaders(c)
+	if isTwirpProtobuf(c.GetHeader("Content-Type")) {
+		msgDescriptor, err := grpcMessageDescriptor(&lookedUpInteraction, fullMethod, true)
+		if err != nil {
+			return err
+		}
+		if len(reqBody) == 0 {
+			reqBody = []byte("{}")
+		}
+		reqBody, err = descriptorlogic.JsonBytesToProtobufBytes(reqBody, msgDescriptor)
+		if err != nil {
+			return err
+		}
+		requestHeaders.Set("Content-Length", strconv.Itoa(len(reqBody)))
+	}
+
+	ul, err := url.ParseRequestURI(deps.CliArgs.RubyCoreUrl + strings.TrimLeft(c.Request.URL.RequestURI(), "/"))
+	if err != nil {
+		return err
+	}
+	req := &http.Request{
+		URL:           ul,
+		Method:        "POST",
+		Header:        requestHeaders,
+		Body:          ioutil.NopCloser(bytes.NewReader(reqBody)),
+		ContentLength: int64(len(reqBody))}
+	response, err := deps.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	contentType := response.Header.Get("Content-Type")
+	if response.StatusCode >= 200 && response.StatusCode < 300 && isTwirpProtobuf(contentType) {
+		responseInteraction, success := deps.InteractionLookup.SelectByResponseStatus(
+			interactionKey, providerStateKnown, response.StatusCode)
+		if !success {
+			responseInteraction = lookedUpInteraction
+		}
+		msgDescriptor, err := grpcMessageDescriptor(&responseInteraction, fullMethod, false)
+		if err != nil {
+			return err
+		}
+		responseBody, err = descriptorlogic.ProtobufBytesToJsonBytes(responseBody, msgDescriptor)
+		if err != nil {
+			return err
+		}
+		contentType = "application/json"
+
+		if success {
+			err := reportBodyMismatches(c, responseInteraction.Description,
+				responseInteraction.Response.Body, responseBody, responseInteraction.Response.MatchingRules, msgDescriptor)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for k, vArr := range response.Header {
+		if strings.EqualFold(k, "Content-Type") || strings.EqualFold(k, "Content-Length") {
+			continue
+		}
+		for _, v := range vArr {
+			c.Writer.Header().Add(k, v)
+		}
+	}
+	c.Data(response.StatusCode, contentType, responseBody)
+	return nil
+}
@@ -0,0 +1,124 @@
+package descriptorlogic
+
+import (
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+)
+
+// A difference between a message as described in the contract and as described by the provider.
+type DescriptorDifference struct {
+	MessageName string
+	FieldName   string
+	Description string
+}
+
+func (d DescriptorDifference) String() string {
+	if d.FieldName == "" {
+		return fmt.Sprintf("%s: %s", d.MessageName, d.Description)
+	}
+	return fmt.Sprintf("%s.%s: %s", d.MessageName, d.FieldName, d.Description)
+}
+
+// Compares a message from the contract with the provider's definition of it field by field, checking that each field
+// keeps its name, number, type and label. Fields holding messages are compared in the same way.
+func CompareMessageDescriptors(contract *desc.MessageDescriptor, provider *desc.MessageDescriptor) []DescriptorDifference {
+	comparison := &descriptorComparison{compared: map[string]bool{}}
+	comparison.compareMessages(contract, provider)
+	return comparison.differences
+}
+
+// Where only the wire format matters, fields are matched by number where their name has changed, removing a field only
+// matters if it's required, and changes to a field's label are allowed. Fields reusing the numbers or names which the
+// contract reserved are reported too.
+type descriptorComparison struct {
+	compared       map[string]bool
+	wireFormatOnly bool
+	differences    []DescriptorDifference
+}
+
+func (comparison *descriptorComparison) addDifference(message *desc.MessageDescriptor, field *desc.FieldDescriptor, format string, args ...interface{}) {
+	difference := DescriptorDifference{
+		MessageName: message.GetFullyQualifiedName(),
+		Description: fmt.Sprintf(format, args...),
+	}
+	if field != nil {
+		difference.FieldName = field.GetName()
+	}
+	comparison.differences = append(comparison.differences, difference)
+}
+
+func (comparison *descriptorComparison) compareMessages(contract *desc.MessageDescriptor, provider *desc.MessageDescriptor) {
+	// Recursive messages need only be compared once
+	if comparison.compared[contract.GetFullyQualifiedName()] {
+		return
+	}
+	comparison.compared[contract.GetFullyQualifiedName()] = true
+
+	for _, contractField := range contract.GetFields() {
+		providerField := provider.FindFieldByName(contractField.GetName())
+		if providerField == nil {
+			renamed := provider.FindFieldByNumber(contractField.GetNumber())
+			switch {
+			case renamed != nil && comparison.wireFormatOnly:
+				providerField = renamed
+			case renamed != nil:
+				comparison.addDifference(contract, contractField, "field number %d renamed to %s",
+					contractField.GetNumber(), renamed.GetName())
+			case !comparison.wireFormatOnly:
+				comparison.addDifference(contract, contractField, "field removed")
+			case contractField.IsRequired():
+				comparison.addDifference(contract, contractField, "required field removed")
+			}
+			if providerField == nil {
+				continue
+			}
+		}
+
+		if providerField.GetNumber() != contractField.GetNumber() {
+			comparison.addDifference(contract, contractField, "field number changed from %d to %d",
+				contractField.GetNumber(), providerField.GetNumber())
+		}
+		if contractType, providerType := fieldTypeName(contractField), fieldTypeName(providerField); contractType != providerType {
+			comparison.addDifference(contract, contractField, "type changed from %s to %s", contractType, providerType)
+		} else if contractField.GetMessageType() != nil {
+			comparison.compareMessages(contractField.GetMessageType(), providerField.GetMessageType())
+		}
+		if providerField.GetLabel() != contractField.GetLabel() && !comparison.wireFormatOnly {
+			comparison.addDifference(contract, contractField, "label changed from %s to %s",
+				contractField.GetLabel(), providerField.GetLabel())
+		}
+	}
+
+	if comparison.wireFormatOnly {
+		comparison.checkReservedFields(contract, provider)
+	}
+}
+
+// Reserved ranges are given with an exclusive end.
+func (comparison *descriptorComparison) checkReservedFields(contract *desc.MessageDescriptor, provider *desc.MessageDescriptor) {
+	contractProto := contract.AsDescriptorProto()
+	for _, providerField := range provider.GetFields() {
+		for _, reservedRange := range contractProto.GetReservedRange() {
+			if providerField.GetNumber() >= reservedRange.GetStart() && providerField.GetNumber() < reservedRange.GetEnd() {
+				comparison.addDifference(contract, providerField, "field reuses reserved number %d", providerField.GetNumber())
+			}
+		}
+		for _, reservedName := range contractProto.GetReservedName() {
+			if reservedName == providerField.GetName() {
+				comparison.addDifference(contract, providerField, "field reuses reserved name")
+			}
+		}
+	}
+}
+
+// Message and enum fields are described by the name of their type, other fields by their scalar type.
+func fieldTypeName(field *desc.FieldDescriptor) string {
+	if field.GetMessageType() != nil {
+		return field.GetMessageType().GetFullyQualifiedName()
+	}
+	if field.GetEnumType() != nil {
+		return field.GetEnumType().GetFullyQualifiedName()
+	}
+	return field.GetType().String()
+}
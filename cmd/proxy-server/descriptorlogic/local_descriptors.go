@@ -0,0 +1,168 @@
+package descriptorlogic
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Descriptors loaded when the proxy starts, from which interactions giving only a message name have their descriptors
+// filled in.
+type LocalDescriptors struct {
+	files []*desc.FileDescriptor
+}
+
+// Every .proto file under the import paths is compiled, with imports resolved against the same paths. Buf images are
+// read in either their binary or JSON form (as written by `buf build -o image.bin` or `-o image.json`).
+func LoadLocalDescriptors(importPaths []string, bufImages []string) (*LocalDescriptors, error) {
+	local := &LocalDescriptors{}
+	loaded := map[string]bool{}
+	addFiles := func(files []*desc.FileDescriptor) {
+		for _, file := range files {
+			if !loaded[file.GetName()] {
+				loaded[file.GetName()] = true
+				local.files = append(local.files, file)
+			}
+		}
+	}
+
+	if len(importPaths) > 0 {
+		files, err := compileImportPaths(importPaths)
+		if err != nil {
+			return nil, err
+		}
+		addFiles(files)
+	}
+	for _, bufImage := range bufImages {
+		files, err := readBufImage(bufImage)
+		if err != nil {
+			return nil, err
+		}
+		addFiles(files)
+	}
+	return local, nil
+}
+
+func compileImportPaths(importPaths []string) ([]*desc.FileDescriptor, error) {
+	fileNames := make([]string, 0)
+	found := map[string]bool{}
+	for _, importPath := range importPaths {
+		err := filepath.Walk(importPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || filepath.Ext(path) != ".proto" {
+				return err
+			}
+			fileName, err := filepath.Rel(importPath, path)
+			if err != nil {
+				return err
+			}
+			// Files are named as they're imported, which is always with forward slashes
+			fileName = filepath.ToSlash(fileName)
+			if !found[fileName] {
+				found[fileName] = true
+				fileNames = append(fileNames, fileName)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(fileNames)
+
+	parser := protoparse.Parser{ImportPaths: importPaths}
+	files, err := parser.ParseFiles(fileNames...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile .proto files: %v", err)
+	}
+	return files, nil
+}
+
+// A Buf image is a FileDescriptorSet with some extra fields of Buf's own, which are ignored here.
+func readBufImage(path string) ([]*desc.FileDescriptor, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileDescriptorSet := &descriptor.FileDescriptorSet{}
+	if filepath.Ext(path) == ".json" {
+		unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+		err = unmarshaler.Unmarshal(bytes.NewReader(data), fileDescriptorSet)
+	} else {
+		err = proto.Unmarshal(data, fileDescriptorSet)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Buf image %s: %v", path, err)
+	}
+
+	filesByName, err := desc.CreateFileDescriptors(fileDescriptorSet.File)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read Buf image %s: %v", path, err)
+	}
+	files := make([]*desc.FileDescriptor, 0, len(filesByName))
+	for _, file := range fileDescriptorSet.File {
+		files = append(files, filesByName[file.GetName()])
+	}
+	return files, nil
+}
+
+// Fills in the descriptors of any protobuf encodings which give neither descriptors nor source. Only the file defining
+// the message (or, where no message is named, the gRPC method) and the files it imports are embedded, so that the
+// contract stays self-contained without carrying every file loaded.
+func (local *LocalDescriptors) FillEncodings(path string, encodings ...*serialization.SerializationEncoding) error {
+	for _, encoding := range encodings {
+		description := encoding.GetProtobufDescription()
+		if description == nil {
+			continue
+		}
+		if len(description.FileDescriptorSet) > 0 || description.FileDescriptorSetBase64 != "" || len(description.ProtoSource) > 0 {
+			continue
+		}
+
+		var file *desc.FileDescriptor
+		if description.MessageName != "" {
+			msg, err := findMessageDescriptor(local.files, description.MessageName, path)
+			if err != nil {
+				return err
+			}
+			file = msg.GetFile()
+		} else {
+			service := local.findServiceForMethod(path)
+			if service == nil {
+				return fmt.Errorf("no messageName given for %s, and it isn't a gRPC method of the loaded descriptors", path)
+			}
+			file = service.GetFile()
+		}
+
+		descriptorBytes, err := proto.Marshal(fileDescriptorSetOf([]*desc.FileDescriptor{file}))
+		if err != nil {
+			return err
+		}
+		description.FileDescriptorSetBase64 = base64.StdEncoding.EncodeToString(descriptorBytes)
+	}
+	return nil
+}
+
+func (local *LocalDescriptors) findServiceForMethod(fullMethod string) *desc.ServiceDescriptor {
+	methodParts := strings.Split(strings.TrimPrefix(fullMethod, "/"), "/")
+	if len(methodParts) != 2 {
+		return nil
+	}
+	for _, file := range local.files {
+		if service := file.FindService(methodParts[0]); service != nil && service.FindMethodByName(methodParts[1]) != nil {
+			return service
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package descriptorlogic
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeBufImages(t *testing.T, directory string) (string, string) {
+	descriptorBytes, err := getEncodingForMessageSpreadOverFiles("").GetProtobufDescription().GetFileDescriptorSetBytes()
+	if err != nil {
+		panic(err)
+	}
+	binaryImage := filepath.Join(directory, "image.bin")
+	assert.Nil(t, ioutil.WriteFile(binaryImage, descriptorBytes, 0666))
+
+	fileDescriptorSet := &descriptor.FileDescriptorSet{}
+	assert.Nil(t, proto.Unmarshal(descriptorBytes, fileDescriptorSet))
+	imageJson, err := (&jsonpb.Marshaler{}).MarshalToString(fileDescriptorSet)
+	if err != nil {
+		panic(err)
+	}
+	// Buf adds fields of its own to each file
+	imageJson = strings.Replace(imageJson, `"name":"common.proto",`, `"name":"common.proto","bufExtension":{"isImport":true},`, 1)
+	jsonImage := filepath.Join(directory, "image.json")
+	assert.Nil(t, ioutil.WriteFile(jsonImage, []byte(imageJson), 0666))
+	return binaryImage, jsonImage
+}
+
+func TestEncodingFilledFromBufImageWithOnlyNeededFiles(t *testing.T) {
+	directory, err := ioutil.TempDir("", "buf-images")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+	binaryImage, jsonImage := writeBufImages(t, directory)
+
+	for _, image := range []string{binaryImage, jsonImage} {
+		localDescriptors, err := LoadLocalDescriptors(nil, []string{image})
+		assert.Nil(t, err, image)
+
+		personEncoding := &serialization.SerializationEncoding{
+			Type:        "protobuf",
+			Description: &serialization.ProtobufEncodingDescription{MessageName: "contract.Person"},
+		}
+		addressEncoding := &serialization.SerializationEncoding{
+			Type:        "protobuf",
+			Description: &serialization.ProtobufEncodingDescription{MessageName: "common.Address"},
+		}
+		err = localDescriptors.FillEncodings("/users", personEncoding, addressEncoding)
+		assert.Nil(t, err, image)
+
+		personSet, err := getFileDescriptorSetFromEncoding(personEncoding)
+		assert.Nil(t, err, image)
+		assert.Len(t, personSet.File, 2, image)
+		addressSet, err := getFileDescriptorSetFromEncoding(addressEncoding)
+		assert.Nil(t, err, image)
+		if assert.Len(t, addressSet.File, 1, image) {
+			assert.Equal(t, "common.proto", addressSet.File[0].GetName(), image)
+		}
+		messageDescriptor, err := GetMessageDescriptorFromBody(personEncoding, "/users")
+		assert.Nil(t, err, image)
+		assert.Equal(t, "contract.Person", messageDescriptor.GetFullyQualifiedName(), image)
+	}
+}
+
+func TestEncodingWithUnknownMessageNotFilled(t *testing.T) {
+	localDescriptors := &LocalDescriptors{}
+	encoding := &serialization.SerializationEncoding{
+		Type:        "protobuf",
+		Description: &serialization.ProtobufEncodingDescription{MessageName: "Company"},
+	}
+
+	err := localDescriptors.FillEncodings("/companies", encoding)
+
+	assert.EqualError(t, err, `message "Company" was not found in the descriptors for /companies`)
+	assert.Empty(t, encoding.GetProtobufDescription().FileDescriptorSetBase64)
+}
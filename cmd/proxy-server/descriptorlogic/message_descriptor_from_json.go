@@ -4,18 +4,22 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"sort"
+	"strings"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/protobuf/protoc-gen-go/descriptor"
 	"github.com/jhump/protoreflect/desc"
 )
 
-func GetMessageDescriptorFromBody(encoding *serialization.SerializationEncoding, path string) (messageDescriptor *desc.MessageDescriptor, err error) {
-	fmt.Println(encoding)
-
-	fileDescriptorSetBytes := make([]byte, 0, 100000)
-	for _, child := range encoding.Description.FileDescriptorSet {
-		fileDescriptorSetBytes = append(fileDescriptorSetBytes, byte(child))
+func getFileDescriptorSetFromEncoding(encoding *serialization.SerializationEncoding) (*descriptor.FileDescriptorSet, error) {
+	description := encoding.GetProtobufDescription()
+	if description == nil {
+		return nil, fmt.Errorf("not a protobuf encoding: %q", encoding.Type)
+	}
+	fileDescriptorSetBytes, err := description.GetFileDescriptorSetBytes()
+	if err != nil {
+		return nil, err
 	}
 
 	fileDescriptorSet := &descriptor.FileDescriptorSet{}
@@ -24,19 +28,105 @@ func GetMessageDescriptorFromBody(encoding *serialization.SerializationEncoding,
 	if err != nil {
 		return nil, err
 	}
+	return fileDescriptorSet, nil
+}
 
-	var fileDescriptor *desc.FileDescriptor
-	fileDescriptor, err = desc.CreateFileDescriptorFromSet(fileDescriptorSet)
+// Every file in the set is returned, in order of name, as the descriptors needed may be in any of them.
+func getFileDescriptorsFromEncoding(encoding *serialization.SerializationEncoding) ([]*desc.FileDescriptor, error) {
+	fileDescriptorSet, err := getFileDescriptorSetFromEncoding(encoding)
 	if err != nil {
 		return nil, err
 	}
 
-	messages := fileDescriptor.GetMessageTypes()
-	for _, msg := range messages {
-		fmt.Println(msg.GetName(), encoding.Description.MessageName)
-		if msg.GetName() == encoding.Description.MessageName {
+	filesByName, err := desc.CreateFileDescriptors(fileDescriptorSet.File)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(filesByName))
+	for name := range filesByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make([]*desc.FileDescriptor, 0, len(names))
+	for _, name := range names {
+		files = append(files, filesByName[name])
+	}
+	return files, nil
+}
+
+func GetMessageDescriptorFromBody(encoding *serialization.SerializationEncoding, path string) (messageDescriptor *desc.MessageDescriptor, err error) {
+	files, err := getFileDescriptorsFromEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	return findMessageDescriptor(files, encoding.GetProtobufDescription().MessageName, path)
+}
+
+// Message names are resolved as fully-qualified names (e.g. "package.Outer.Inner") first. Failing that, a message whose
+// name ends with the given name is accepted, so "Inner", "Outer.Inner" and (for a package-less file) the fully
+// qualified name all work, so long as only one message matches.
+func findMessageDescriptor(files []*desc.FileDescriptor, messageName string, path string) (*desc.MessageDescriptor, error) {
+	messageName = strings.TrimPrefix(messageName, ".")
+	for _, file := range files {
+		if msg := file.FindMessage(messageName); msg != nil {
+			return msg, nil
+		}
+	}
+
+	matches := map[string]*desc.MessageDescriptor{}
+	for _, file := range files {
+		addMessagesMatchingName(matches, file.GetMessageTypes(), messageName)
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("message %q was not found in the descriptors for %s", messageName, path)
+	case 1:
+		for _, msg := range matches {
 			return msg, nil
 		}
 	}
-	return nil, errors.New("Expected route was not found in interactions: " + path)
+	candidates := make([]string, 0, len(matches))
+	for name := range matches {
+		candidates = append(candidates, name)
+	}
+	sort.Strings(candidates)
+	return nil, fmt.Errorf("message name %q is ambiguous for %s, give one of: %s",
+		messageName, path, strings.Join(candidates, ", "))
+}
+
+func addMessagesMatchingName(matches map[string]*desc.MessageDescriptor, messages []*desc.MessageDescriptor, messageName string) {
+	for _, msg := range messages {
+		fullName := msg.GetFullyQualifiedName()
+		if fullName == messageName || strings.HasSuffix(fullName, "."+messageName) {
+			matches[fullName] = msg
+		}
+		addMessagesMatchingName(matches, msg.GetNestedMessageTypes(), messageName)
+	}
+}
+
+// gRPC methods are named as "/package.Service/Method", which is also the path of the interaction representing them.
+func GetMethodDescriptorFromBody(encoding *serialization.SerializationEncoding, fullMethod string) (*desc.MethodDescriptor, error) {
+	files, err := getFileDescriptorsFromEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	methodParts := strings.Split(strings.TrimPrefix(fullMethod, "/"), "/")
+	if len(methodParts) != 2 {
+		return nil, errors.New("Not a gRPC method name: " + fullMethod)
+	}
+	var service *desc.ServiceDescriptor
+	for _, file := range files {
+		if service = file.FindService(methodParts[0]); service != nil {
+			break
+		}
+	}
+	if service == nil {
+		return nil, errors.New("Service not found in file descriptors: " + methodParts[0])
+	}
+	method := service.FindMethodByName(methodParts[1])
+	if method == nil {
+		return nil, errors.New("Method not found in file descriptors: " + fullMethod)
+	}
+	return method, nil
 }
@@ -0,0 +1,101 @@
+package descriptorlogic
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+// A user in one file, whose address comes from a dependency holding a message of the same name in another package
+func getEncodingForMessageSpreadOverFiles(messageName string) *serialization.SerializationEncoding {
+	common := &descriptor.FileDescriptorProto{
+		Name:    proto.String("common.proto"),
+		Package: proto.String("common"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{{
+			Name: proto.String("Address"),
+			Field: []*descriptor.FieldDescriptorProto{{
+				Name:     proto.String("lines"),
+				Number:   proto.Int32(1),
+				Type:     descriptor.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+				TypeName: proto.String(".common.Address.Line"),
+				Label:    descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+			}},
+			NestedType: []*descriptor.DescriptorProto{{
+				Name: proto.String("Line"),
+				Field: []*descriptor.FieldDescriptorProto{{
+					Name:   proto.String("text"),
+					Number: proto.Int32(1),
+					Type:   descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}},
+			}},
+		}},
+	}
+	contract := &descriptor.FileDescriptorProto{
+		Name:       proto.String("contract.proto"),
+		Package:    proto.String("contract"),
+		Syntax:     proto.String("proto3"),
+		Dependency: []string{"common.proto"},
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("Person"),
+				Field: []*descriptor.FieldDescriptorProto{{
+					Name:     proto.String("address"),
+					Number:   proto.Int32(1),
+					Type:     descriptor.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+					TypeName: proto.String(".common.Address"),
+					Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}},
+			},
+			{Name: proto.String("Address")},
+		},
+	}
+	descriptorBytes, err := proto.Marshal(&descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{common, contract}})
+	if err != nil {
+		panic(err)
+	}
+	return &serialization.SerializationEncoding{
+		Type: "protobuf",
+		Description: &serialization.ProtobufEncodingDescription{
+			MessageName:             messageName,
+			FileDescriptorSetBase64: base64.StdEncoding.EncodeToString(descriptorBytes),
+		},
+	}
+}
+
+func TestMessagesResolvedAcrossFilesByFullOrPartialName(t *testing.T) {
+	for messageName, expected := range map[string]string{
+		"contract.Person":     "contract.Person",
+		".contract.Person":    "contract.Person",
+		"Person":              "contract.Person",
+		"common.Address":      "common.Address",
+		"common.Address.Line": "common.Address.Line",
+		"Address.Line":        "common.Address.Line",
+		"Line":                "common.Address.Line",
+		"contract.Address":    "contract.Address",
+	} {
+		messageDescriptor, err := GetMessageDescriptorFromBody(getEncodingForMessageSpreadOverFiles(messageName), "/users")
+
+		assert.Nil(t, err, messageName)
+		if assert.NotNil(t, messageDescriptor, messageName) {
+			assert.Equal(t, expected, messageDescriptor.GetFullyQualifiedName(), messageName)
+		}
+	}
+}
+
+func TestAmbiguousMessageNameReported(t *testing.T) {
+	_, err := GetMessageDescriptorFromBody(getEncodingForMessageSpreadOverFiles("Address"), "/users")
+
+	assert.EqualError(t, err, `message name "Address" is ambiguous for /users, give one of: common.Address, contract.Address`)
+}
+
+func TestUnknownMessageNameReported(t *testing.T) {
+	_, err := GetMessageDescriptorFromBody(getEncodingForMessageSpreadOverFiles("Company"), "/users")
+
+	assert.EqualError(t, err, `message "Company" was not found in the descriptors for /users`)
+}
@@ -0,0 +1,82 @@
+package descriptorlogic
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Compiles the .proto source given with any of the encodings, replacing it with the resulting descriptors so that the
+// encoding is held (and written to the contract) in the same form as one registered with compiled descriptors.
+func CompileProtoSources(encodings ...*serialization.SerializationEncoding) error {
+	for _, encoding := range encodings {
+		description := encoding.GetProtobufDescription()
+		if description == nil || len(description.ProtoSource) == 0 {
+			continue
+		}
+		descriptorBytes, err := compileProtoSource(description.ProtoSource)
+		if err != nil {
+			return err
+		}
+		description.FileDescriptorSetBase64 = base64.StdEncoding.EncodeToString(descriptorBytes)
+		description.FileDescriptorSet = nil
+		description.ProtoSource = nil
+	}
+	return nil
+}
+
+// Every file given is compiled, with imports resolved from the files given (other than the standard imports, such as
+// google/protobuf/timestamp.proto, which the parser provides itself).
+func compileProtoSource(source map[string]string) ([]byte, error) {
+	fileNames := make([]string, 0, len(source))
+	for fileName := range source {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	parser := protoparse.Parser{
+		Accessor: func(fileName string) (io.ReadCloser, error) {
+			contents, present := source[fileName]
+			if !present {
+				return nil, os.ErrNotExist
+			}
+			return ioutil.NopCloser(strings.NewReader(contents)), nil
+		},
+	}
+	files, err := parser.ParseFiles(fileNames...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile protoSource: %v", err)
+	}
+	return proto.Marshal(fileDescriptorSetOf(files))
+}
+
+// Dependencies are included ahead of the files which import them, as protoc does with --include_imports.
+func fileDescriptorSetOf(files []*desc.FileDescriptor) *descriptor.FileDescriptorSet {
+	fileDescriptorSet := &descriptor.FileDescriptorSet{}
+	included := map[string]bool{}
+	var include func(file *desc.FileDescriptor)
+	include = func(file *desc.FileDescriptor) {
+		if included[file.GetName()] {
+			return
+		}
+		included[file.GetName()] = true
+		for _, dependency := range file.GetDependencies() {
+			include(dependency)
+		}
+		fileDescriptorSet.File = append(fileDescriptorSet.File, file.AsFileDescriptorProto())
+	}
+	for _, file := range files {
+		include(file)
+	}
+	return fileDescriptorSet
+}
@@ -17,3 +17,14 @@ func JsonBytesToProtobufBytes(jsonBytes []byte, messageDescriptor *desc.MessageD
 
 	return protoMessage.Marshal()
 }
+
+func ProtobufBytesToJsonBytes(protoBytes []byte, messageDescriptor *desc.MessageDescriptor) ([]byte, error) {
+	protoMessage := dynamic.NewMessage(messageDescriptor)
+
+	err := protoMessage.Unmarshal(protoBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return protoMessage.MarshalJSON()
+}
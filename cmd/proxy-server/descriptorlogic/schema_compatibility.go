@@ -0,0 +1,102 @@
+package descriptorlogic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Reads a FileDescriptorSet as written by `protoc --descriptor_set_out`.
+func ReadFileDescriptorSet(path string) (*descriptor.FileDescriptorSet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileDescriptorSet := &descriptor.FileDescriptorSet{}
+	err = proto.Unmarshal(data, fileDescriptorSet)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read FileDescriptorSet from %s: %v", path, err)
+	}
+	return fileDescriptorSet, nil
+}
+
+// Gathers the files described by every protobuf encoding in the contract into a single set. Files are identified by
+// name, so a file carried by several interactions is only included once.
+func ContractFileDescriptorSet(contract *serialization.PactContract) (*descriptor.FileDescriptorSet, error) {
+	encodings := make([]*serialization.SerializationEncoding, 0)
+	for _, interaction := range contract.Interactions {
+		encodings = append(encodings, interaction.Request.Encoding, interaction.Response.Encoding)
+	}
+	for _, message := range contract.Messages {
+		encodings = append(encodings, message.Encoding)
+	}
+
+	contractSet := &descriptor.FileDescriptorSet{}
+	included := map[string]bool{}
+	for _, encoding := range encodings {
+		if encoding.GetProtobufDescription() == nil {
+			continue
+		}
+		fileDescriptorSet, err := getFileDescriptorSetFromEncoding(encoding)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range fileDescriptorSet.File {
+			if !included[file.GetName()] {
+				included[file.GetName()] = true
+				contractSet.File = append(contractSet.File, file)
+			}
+		}
+	}
+	return contractSet, nil
+}
+
+// Checks that data written with the contract's descriptors is still understood in the same way by the provider's.
+// Unlike CompareMessageDescriptors, only changes which break the wire format are reported: a field which has been
+// renumbered or retyped, a required field which has been removed, or a field number or name which the contract
+// reserved being reused. Messages are compared by full name, and those missing from the provider's set are skipped.
+// Each set must include the files its files import, as written by `protoc --include_imports`.
+func CheckSchemaCompatibility(contract *descriptor.FileDescriptorSet, provider *descriptor.FileDescriptorSet) ([]DescriptorDifference, error) {
+	contractFiles, err := desc.CreateFileDescriptors(contract.File)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the contract's descriptors: %v", err)
+	}
+	providerFiles, err := desc.CreateFileDescriptors(provider.File)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the provider's descriptors: %v", err)
+	}
+	providerMessages := map[string]*desc.MessageDescriptor{}
+	for _, file := range providerFiles {
+		addMessagesByFullName(providerMessages, file.GetMessageTypes())
+	}
+
+	comparison := &descriptorComparison{compared: map[string]bool{}, wireFormatOnly: true}
+	for _, file := range contract.File {
+		contractMessages := map[string]*desc.MessageDescriptor{}
+		addMessagesByFullName(contractMessages, contractFiles[file.GetName()].GetMessageTypes())
+		names := make([]string, 0, len(contractMessages))
+		for name := range contractMessages {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if providerMessage, present := providerMessages[name]; present {
+				comparison.compareMessages(contractMessages[name], providerMessage)
+			}
+		}
+	}
+	return comparison.differences, nil
+}
+
+func addMessagesByFullName(messages map[string]*desc.MessageDescriptor, messageTypes []*desc.MessageDescriptor) {
+	for _, message := range messageTypes {
+		messages[message.GetFullyQualifiedName()] = message
+		addMessagesByFullName(messages, message.GetNestedMessageTypes())
+	}
+}
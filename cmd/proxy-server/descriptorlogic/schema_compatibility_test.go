@@ -0,0 +1,77 @@
+package descriptorlogic
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/stretchr/testify/assert"
+)
+
+func getUserFileDescriptorSet(fields ...*descriptor.FieldDescriptorProto) *descriptor.FileDescriptorSet {
+	return &descriptor.FileDescriptorSet{
+		File: []*descriptor.FileDescriptorProto{{
+			Name:    proto.String("contract.proto"),
+			Package: proto.String("contract"),
+			Syntax:  proto.String("proto2"),
+			MessageType: []*descriptor.DescriptorProto{{
+				Name:  proto.String("Person"),
+				Field: fields,
+			}},
+		}},
+	}
+}
+
+func getField(name string, number int32, fieldType descriptor.FieldDescriptorProto_Type, label descriptor.FieldDescriptorProto_Label) *descriptor.FieldDescriptorProto {
+	return &descriptor.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   fieldType.Enum(),
+		Label:  label.Enum(),
+	}
+}
+
+func TestCompatibleSchemaChangesAllowed(t *testing.T) {
+	contract := getUserFileDescriptorSet(
+		getField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_REQUIRED),
+		getField("nickname", 2, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_OPTIONAL),
+		getField("id", 3, descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_LABEL_OPTIONAL))
+	// Renaming a field, removing an optional field and adding a field leave the wire format intact
+	provider := getUserFileDescriptorSet(
+		getField("full_name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_REQUIRED),
+		getField("id", 3, descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_LABEL_OPTIONAL),
+		getField("email", 4, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_OPTIONAL))
+
+	incompatibilities, err := CheckSchemaCompatibility(contract, provider)
+	assert.Nil(t, err)
+	assert.Empty(t, incompatibilities)
+}
+
+func TestBreakingSchemaChangesReported(t *testing.T) {
+	contract := getUserFileDescriptorSet(
+		getField("name", 1, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_REQUIRED),
+		getField("id", 2, descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_LABEL_OPTIONAL),
+		getField("age", 3, descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_LABEL_OPTIONAL))
+	contract.File[0].MessageType[0].ReservedRange = []*descriptor.DescriptorProto_ReservedRange{
+		{Start: proto.Int32(5), End: proto.Int32(6)}}
+	contract.File[0].MessageType[0].ReservedName = []string{"email"}
+	provider := getUserFileDescriptorSet(
+		getField("id", 4, descriptor.FieldDescriptorProto_TYPE_INT32, descriptor.FieldDescriptorProto_LABEL_OPTIONAL),
+		getField("age", 3, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_OPTIONAL),
+		getField("email", 5, descriptor.FieldDescriptorProto_TYPE_STRING, descriptor.FieldDescriptorProto_LABEL_OPTIONAL))
+
+	incompatibilities, err := CheckSchemaCompatibility(contract, provider)
+	assert.Nil(t, err)
+
+	descriptions := make([]string, 0, len(incompatibilities))
+	for _, incompatibility := range incompatibilities {
+		descriptions = append(descriptions, incompatibility.String())
+	}
+	assert.Equal(t, []string{
+		"contract.Person.name: required field removed",
+		"contract.Person.id: field number changed from 2 to 4",
+		"contract.Person.age: type changed from TYPE_INT32 to TYPE_STRING",
+		"contract.Person.email: field reuses reserved number 5",
+		"contract.Person.email: field reuses reserved name",
+	}, descriptions)
+}
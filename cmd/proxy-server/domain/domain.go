@@ -1,12 +1,19 @@
 package domain
 
 import (
+	"errors"
 	"fmt"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
 	"github.com/mkideal/cli"
+	"net/url"
+	"regexp"
+	"strings"
 	"sync"
 )
 
+// Used as a fallback for the provider state header when verifying, as with the Ruby core.
+const ProviderStateEnvironmentVariable = "PACT_PROVIDER_STATE"
+
 type CliArgs struct {
 	cli.Helper
 	Verificaion bool   `cli:"verification" usage:"set if the server is being used in pact verification"`
@@ -16,20 +23,61 @@ type CliArgs struct {
 	Host        string `cli:"host" usage:"host name on which to run the server: --pact-dir <directory>" dft:"localhost"`
 	// TODO: Should make this "OutputUrl", as it's not the ruby core when doing verification.
 	RubyCoreUrl string `cli:"*ruby-core-url" usage:"URL where the Ruby core is running --ruby-core-url <url>"`
+	// The Ruby core tells the provider which state to set up, rather than telling us, so the provider state of the
+	// interaction being verified has to be passed in either through a header or through the environment.
+	ProviderStateHeader      string `cli:"provider-state-header" usage:"header carrying the provider state during verification: --provider-state-header <header>" dft:"X-Pact-Provider-State"`
+	PactSpecificationVersion string `cli:"pact-specification-version" usage:"version of the Pact specification to write the pact in, if not that used by the Ruby core: --pact-specification-version <version>"`
+	// Interactions can give only a message name, with their descriptors taken from those loaded here at startup.
+	ProtoPaths []string `cli:"proto-path" usage:"import path to load .proto files from, may be given more than once: --proto-path <directory>"`
+	BufImages  []string `cli:"buf-image" usage:"Buf image to load descriptors from, may be given more than once: --buf-image <file>"`
+	// Bodies framed for a schema registry can give only their subject, with their schema resolved from the registry or
+	// from a directory of schemas saved from one.
+	SchemaRegistryUrl string `cli:"schema-registry-url" usage:"URL of the schema registry to resolve schemas from, with any credentials in the URL: --schema-registry-url <url>"`
+	SchemaDirectory   string `cli:"schema-directory" usage:"directory of schemas to resolve schemas from, saved as JSON from a schema registry's /subjects/<subject>/versions/<version>: --schema-directory <directory>"`
+	// Descriptors are written as base64 strings, unless they're needed in the form older versions of the proxy read.
+	NumericDescriptorSets bool `cli:"numeric-descriptor-sets" usage:"set to write descriptors to the pact as arrays of byte values, rather than as base64"`
+	// Message pacts are written by the proxy itself, rather than the Ruby core, so the pacticipants must be named here.
+	Messages bool   `cli:"messages" usage:"set if the server is being used for message pacts"`
+	Consumer string `cli:"consumer" usage:"name of the consumer, when writing message pacts: --consumer <name>"`
+	Provider string `cli:"provider" usage:"name of the provider, when writing message pacts: --provider <name>"`
+	// gRPC calls are served on a port of their own, as gin only serves HTTP/1.
+	GrpcPort int `cli:"grpc-port" usage:"port on which to serve gRPC, if gRPC is being used: --grpc-port <port>"`
+	// When verifying, interactions for gRPC methods are verified by calling the provider over gRPC rather than HTTP.
+	GrpcProviderAddress string `cli:"grpc-provider-address" usage:"address of the provider's gRPC server, when verifying gRPC interactions: --grpc-provider-address <host:port>"`
+	GrpcProviderTls     bool   `cli:"grpc-provider-tls" usage:"set if the provider's gRPC server uses TLS"`
+	GrpcProviderCaCert  string `cli:"grpc-provider-ca-cert" usage:"CA certificate to trust for the provider's gRPC server, if not a system one: --grpc-provider-ca-cert <file>"`
+	GrpcReflection      bool   `cli:"grpc-reflection" usage:"set to compare the contract's descriptors with those the provider serves over gRPC server reflection before verifying"`
+	// Twirp RPCs are served from the dynamic endpoints, with their messages taken from the service definitions.
+	Twirp       bool   `cli:"twirp" usage:"set if the server is being used for Twirp RPCs"`
+	TwirpPrefix string `cli:"twirp-prefix" usage:"path prefix under which Twirp RPCs are served: --twirp-prefix <prefix>" dft:"/twirp"`
+	// The provider's current descriptors can be checked against the contract's for changes which break the wire format.
+	ProviderDescriptorSet string `cli:"provider-descriptor-set" usage:"FileDescriptorSet describing the provider's protobuf schema, checked for breaking changes before verifying: --provider-descriptor-set <file>"`
+	FailOnBreakingChanges bool   `cli:"fail-on-breaking-changes" usage:"set to fail verification if the provider's schema has breaking changes from the contract's"`
 	// TODO: Should add support for SSL
 }
 
+// Called by cli before running, as for the required flags: message pacts are named after their pacticipants, which the
+// Ruby core names for HTTP pacts.
+func (args *CliArgs) Validate(ctx *cli.Context) error {
+	if args.Messages && !args.Verificaion && (args.Consumer == "" || args.Provider == "") {
+		return errors.New("--consumer and --provider are required when writing message pacts")
+	}
+	return nil
+}
+
 type UniqueInteractionIdentifier struct {
-	method string
-	path   string
-	query  string
+	method        string
+	path          string
+	query         string
+	providerState string
 }
 
-func CreateUniqueInteractionIdentifier(method string, path string, query string) UniqueInteractionIdentifier {
+func CreateUniqueInteractionIdentifier(method string, path string, query string, providerState string) UniqueInteractionIdentifier {
 	return UniqueInteractionIdentifier{
-		method: method,
-		path:   path,
-		query:  query,
+		method:        method,
+		path:          path,
+		query:         normaliseQuery(query),
+		providerState: providerState,
 	}
 }
 
@@ -39,43 +87,181 @@ func CreateUniqueInteractionIdentifierFromInteraction(interaction *serialization
 		queryString = interaction.Request.Query.GetString()
 	}
 	return UniqueInteractionIdentifier{
-		method: interaction.Request.Method,
-		path:   interaction.Request.Path.GetString(),
-		query:  queryString,
+		method:        interaction.Request.Method,
+		path:          interaction.Request.Path.GetString(),
+		query:         normaliseQuery(queryString),
+		providerState: interaction.GetProviderState(),
+	}
+}
+
+// Pact v3 queries are a map, so don't have an ordering - queries are compared with their parameters sorted.
+func normaliseQuery(query string) string {
+	parsedQuery, err := url.ParseQuery(strings.TrimPrefix(query, "?"))
+	if err != nil {
+		return query
+	}
+	return parsedQuery.Encode()
+}
+
+func (id UniqueInteractionIdentifier) sameEndpoint(other UniqueInteractionIdentifier) bool {
+	return id.method == other.method && id.path == other.path && id.query == other.query
+}
+
+// Interactions registered with a Pact term for their path or query are matched against requests using the term's
+// regex, where no interaction matches exactly.
+type endpointMatcher struct {
+	path  *regexp.Regexp
+	query *regexp.Regexp
+}
+
+// Ruby regexes which RE2 can't compile (e.g. those using lookaheads) fall back to matching the generated example
+// exactly, with a warning, rather than losing the interaction.
+func createEndpointMatcher(interaction *serialization.ProviderServiceInteraction) *endpointMatcher {
+	pathRegex, err := interaction.Request.Path.GetRegex()
+	// Pact contracts carry the path regex in the matching rules, rather than as a term
+	if rulesRegex := serialization.GetPathRegexFromMatchingRules(interaction.Request.MatchingRules); pathRegex == nil && err == nil && rulesRegex != "" {
+		pathRegex, err = regexp.Compile(rulesRegex)
+	}
+	if err != nil {
+		fmt.Printf("Warning: matching the path of %q exactly, as its regex can't be used: %v\n", interaction.Description, err)
+	}
+	var queryRegex *regexp.Regexp
+	if interaction.Request.Query != nil {
+		queryRegex, err = interaction.Request.Query.GetRegex()
+		if err != nil {
+			fmt.Printf("Warning: matching the query of %q exactly, as its regex can't be used: %v\n", interaction.Description, err)
+		}
+	}
+	if pathRegex == nil && queryRegex == nil {
+		return nil
 	}
+	return &endpointMatcher{path: pathRegex, query: queryRegex}
 }
 
-// In general, there can be multiple interactions per endpoint, whose serialization can differ - in the longer term
-// this will have to be a map[UniqueInteractionIdentifier] -> []*ProviderServiceInteraction.
+func matchesExactlyOrByRegex(value string, example string, regex *regexp.Regexp) bool {
+	if regex == nil {
+		return value == example
+	}
+	return regex.MatchString(value)
+}
+
+func (matcher *endpointMatcher) matches(key UniqueInteractionIdentifier, identifier UniqueInteractionIdentifier) bool {
+	return key.method == identifier.method &&
+		matchesExactlyOrByRegex(identifier.path, key.path, matcher.path) &&
+		matchesExactlyOrByRegex(identifier.query, key.query, matcher.query)
+}
+
+// There can be multiple interactions per endpoint, whose serialization can differ: these are keyed by the provider
+// state they're registered under, and in registration order within a given provider state. Each interaction's matcher
+// is held at the same index as the interaction, and is nil for interactions without a term.
 type InteractionLookup struct {
-	_map map[UniqueInteractionIdentifier]serialization.ProviderServiceInteraction
-	lock sync.Mutex
+	_map     map[UniqueInteractionIdentifier][]serialization.ProviderServiceInteraction
+	keys     []UniqueInteractionIdentifier
+	matchers map[UniqueInteractionIdentifier][]*endpointMatcher
+	lock     sync.Mutex
 }
 
-func (il *InteractionLookup) Get(identifier UniqueInteractionIdentifier) (serialization.ProviderServiceInteraction, bool) {
+func (il *InteractionLookup) Get(identifier UniqueInteractionIdentifier) ([]serialization.ProviderServiceInteraction, bool) {
 	il.lock.Lock()
 	defer il.lock.Unlock()
 
 	value, success := il._map[identifier]
 	return value, success
 }
-func (il *InteractionLookup) Set(identifier UniqueInteractionIdentifier, interaction serialization.ProviderServiceInteraction) error {
+
+// Returns the interactions registered for the endpoint of the identifier under any provider state - this is what's
+// needed when the provider state isn't known at request time, as is the case when the consumer is under test.
+func (il *InteractionLookup) GetIgnoringProviderState(identifier UniqueInteractionIdentifier) ([]serialization.ProviderServiceInteraction, bool) {
+	il.lock.Lock()
+	defer il.lock.Unlock()
+
+	interactions := make([]serialization.ProviderServiceInteraction, 0)
+	for _, key := range il.keys {
+		if key.sameEndpoint(identifier) {
+			interactions = append(interactions, il._map[key]...)
+		}
+	}
+	return interactions, len(interactions) > 0
+}
+
+// Returns the interactions a request could pertain to: exact matches on the endpoint win over regex matches.
+func (il *InteractionLookup) candidates(identifier UniqueInteractionIdentifier, providerStateKnown bool) []serialization.ProviderServiceInteraction {
+	var interactions []serialization.ProviderServiceInteraction
+	if providerStateKnown {
+		interactions, _ = il.Get(identifier)
+	} else {
+		interactions, _ = il.GetIgnoringProviderState(identifier)
+	}
+	if len(interactions) > 0 {
+		return interactions
+	}
+
+	il.lock.Lock()
+	defer il.lock.Unlock()
+
+	for _, key := range il.keys {
+		if providerStateKnown && key.providerState != identifier.providerState {
+			continue
+		}
+		for i, matcher := range il.matchers[key] {
+			if matcher != nil && matcher.matches(key, identifier) {
+				interactions = append(interactions, il._map[key][i])
+			}
+		}
+	}
+	return interactions
+}
+
+// Chooses the interaction which a request pertains to: where several interactions are registered for a single
+// endpoint, the first registered is chosen.
+func (il *InteractionLookup) Select(identifier UniqueInteractionIdentifier, providerStateKnown bool) (serialization.ProviderServiceInteraction, bool) {
+	interactions := il.candidates(identifier, providerStateKnown)
+	if len(interactions) == 0 {
+		return serialization.ProviderServiceInteraction{}, false
+	}
+	return interactions[0], true
+}
+
+// Chooses the interaction whose response has the given status: different response statuses for a single endpoint
+// may carry different message types (e.g. an error message for a 400).
+func (il *InteractionLookup) SelectByResponseStatus(
+	identifier UniqueInteractionIdentifier, providerStateKnown bool, status int) (serialization.ProviderServiceInteraction, bool) {
+	for _, interaction := range il.candidates(identifier, providerStateKnown) {
+		if interaction.Response.Status == status {
+			return interaction, true
+		}
+	}
+	return serialization.ProviderServiceInteraction{}, false
+}
+
+func (il *InteractionLookup) Add(identifier UniqueInteractionIdentifier, interaction serialization.ProviderServiceInteraction) error {
+	matcher := createEndpointMatcher(&interaction)
+
 	il.lock.Lock()
 	defer il.lock.Unlock()
 
-	// Don't try to overwrite
-	_, failure := il._map[identifier]
-	if failure {
-		return fmt.Errorf("key %v already in map", identifier)
+	// A given interaction is identified by its description and provider state, don't try to overwrite
+	existing, found := il._map[identifier]
+	for _, existingInteraction := range existing {
+		if existingInteraction.Description == interaction.Description {
+			return fmt.Errorf("interaction %q for key %v already in map", interaction.Description, identifier)
+		}
+	}
+	if !found {
+		il.keys = append(il.keys, identifier)
 	}
-	il._map[identifier] = interaction
+	il.matchers[identifier] = append(il.matchers[identifier], matcher)
+	il._map[identifier] = append(existing, interaction)
 	fmt.Println("Added path: ", identifier)
 	return nil
 }
+
 func CreateEmptyInteractionLookup() *InteractionLookup {
 	return &InteractionLookup{
-		_map: map[UniqueInteractionIdentifier]serialization.ProviderServiceInteraction{},
-		lock: sync.Mutex{},
+		_map:     map[UniqueInteractionIdentifier][]serialization.ProviderServiceInteraction{},
+		keys:     []UniqueInteractionIdentifier{},
+		matchers: map[UniqueInteractionIdentifier][]*endpointMatcher{},
+		lock:     sync.Mutex{},
 	}
 }
 
@@ -83,15 +269,12 @@ func CreateInteractionLookupFromContract(contract *serialization.PactContract) *
 	interactionLookup := CreateEmptyInteractionLookup()
 	for _, interaction := range contract.Interactions {
 		key := CreateUniqueInteractionIdentifierFromInteraction(&interaction)
-		err := interactionLookup.Set(key, interaction)
+		err := interactionLookup.Add(key, interaction)
 
-		// A valid PactContract shouldn't repeat any interactions, however given we don't include providerState in
-		// the unique interaction identifier there is the possibility of a clash - given we only need the encoding field
-		// from the pact interaction, we can get away with just checking that this is the same.
-		// Note: this approach does mean that APIs which return different serialization for different response codes
-		// will not work properly.
+		// A valid PactContract shouldn't repeat any interactions, so this should only happen if the contract has
+		// been edited by hand.
 		if err != nil {
-			fmt.Printf("Interaction duplicate: %v\n", key)
+			fmt.Printf("Unable to add interaction %v: %v\n", key, err)
 		}
 	}
 	return interactionLookup
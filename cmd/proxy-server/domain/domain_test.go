@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"testing"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+func interactionWithPathTerm(description string, example string, regex string) serialization.ProviderServiceInteraction {
+	return serialization.ProviderServiceInteraction{
+		Description: description,
+		Request: serialization.ProviderServiceRequest{
+			Method: "get",
+			Path: &serialization.PossiblyRegexedString{
+				WithRegex: &serialization.RegexedString{
+					JsonClass: "Pact::Term",
+					Data: &serialization.RexexMatcher{
+						ExamplePath: example,
+						Matcher:     serialization.RegexMatcherDescription{JsonClass: "Regexp", Source: regex},
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestInteractionsUnderOneKeyKeepTheirOwnRegex(t *testing.T) {
+	lookup := CreateEmptyInteractionLookup()
+	for _, interaction := range []serialization.ProviderServiceInteraction{
+		interactionWithPathTerm("Get a user by id", "/users/1", `^/users/\d+$`),
+		interactionWithPathTerm("Get a user by name", "/users/1", `^/users/[a-z]+$`),
+	} {
+		assert.Nil(t, lookup.Add(CreateUniqueInteractionIdentifierFromInteraction(&interaction), interaction))
+	}
+
+	interaction, found := lookup.Select(CreateUniqueInteractionIdentifier("get", "/users/42", "", ""), false)
+	assert.True(t, found)
+	assert.Equal(t, "Get a user by id", interaction.Description)
+
+	interaction, found = lookup.Select(CreateUniqueInteractionIdentifier("get", "/users/joe", "", ""), false)
+	assert.True(t, found)
+	assert.Equal(t, "Get a user by name", interaction.Description)
+}
+
+func TestRegexWhichCantBeCompiledMatchesTheExampleExactly(t *testing.T) {
+	lookup := CreateEmptyInteractionLookup()
+	// RE2 has no lookaheads
+	interaction := interactionWithPathTerm("Get a user", "/users/1", `^/users/(?=\d)\d+$`)
+	assert.Nil(t, lookup.Add(CreateUniqueInteractionIdentifierFromInteraction(&interaction), interaction))
+
+	_, found := lookup.Select(CreateUniqueInteractionIdentifier("get", "/users/1", "", ""), false)
+	assert.True(t, found)
+	_, found = lookup.Select(CreateUniqueInteractionIdentifier("get", "/users/42", "", ""), false)
+	assert.False(t, found)
+}
+
+func TestPacticipantsRequiredWhenWritingMessagePacts(t *testing.T) {
+	args := &CliArgs{Messages: true, Consumer: "consumer"}
+	assert.EqualError(t, args.Validate(nil), "--consumer and --provider are required when writing message pacts")
+
+	args.Provider = "provider"
+	assert.Nil(t, args.Validate(nil))
+	assert.Nil(t, (&CliArgs{Messages: true, Verificaion: true}).Validate(nil))
+	assert.Nil(t, (&CliArgs{}).Validate(nil))
+}
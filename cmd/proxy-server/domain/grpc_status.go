@@ -0,0 +1,65 @@
+package domain
+
+import (
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+)
+
+// Pact interactions only know about HTTP statuses, so gRPC status codes are represented by their closest HTTP
+// equivalents (following the mapping used by grpc-gateway).
+var grpcCodeToHttpStatus = map[codes.Code]int{
+	codes.OK:                 http.StatusOK,
+	codes.Canceled:           499,
+	codes.Unknown:            http.StatusInternalServerError,
+	codes.InvalidArgument:    http.StatusBadRequest,
+	codes.DeadlineExceeded:   http.StatusGatewayTimeout,
+	codes.NotFound:           http.StatusNotFound,
+	codes.AlreadyExists:      http.StatusConflict,
+	codes.PermissionDenied:   http.StatusForbidden,
+	codes.ResourceExhausted:  http.StatusTooManyRequests,
+	codes.FailedPrecondition: http.StatusPreconditionFailed,
+	codes.Aborted:            http.StatusConflict,
+	codes.OutOfRange:         http.StatusBadRequest,
+	codes.Unimplemented:      http.StatusNotImplemented,
+	codes.Internal:           http.StatusInternalServerError,
+	codes.Unavailable:        http.StatusServiceUnavailable,
+	codes.DataLoss:           http.StatusInternalServerError,
+	codes.Unauthenticated:    http.StatusUnauthorized,
+}
+
+// Where several codes share an HTTP status, it maps back to the code a provider is most likely to have returned: 400 is
+// InvalidArgument rather than OutOfRange, 409 is AlreadyExists rather than Aborted, and 500 is Internal rather than
+// Unknown or DataLoss. Statuses with no code of their own are Unknown, unless they're successes.
+var httpStatusToGrpcCode = map[int]codes.Code{
+	http.StatusOK:                  codes.OK,
+	499:                            codes.Canceled,
+	http.StatusBadRequest:          codes.InvalidArgument,
+	http.StatusGatewayTimeout:      codes.DeadlineExceeded,
+	http.StatusNotFound:            codes.NotFound,
+	http.StatusConflict:            codes.AlreadyExists,
+	http.StatusForbidden:           codes.PermissionDenied,
+	http.StatusTooManyRequests:     codes.ResourceExhausted,
+	http.StatusPreconditionFailed:  codes.FailedPrecondition,
+	http.StatusNotImplemented:      codes.Unimplemented,
+	http.StatusInternalServerError: codes.Internal,
+	http.StatusServiceUnavailable:  codes.Unavailable,
+	http.StatusUnauthorized:        codes.Unauthenticated,
+}
+
+func GrpcCodeFromHttpStatus(status int) codes.Code {
+	if code, present := httpStatusToGrpcCode[status]; present {
+		return code
+	}
+	if status >= 200 && status < 300 {
+		return codes.OK
+	}
+	return codes.Unknown
+}
+
+func HttpStatusFromGrpcCode(code codes.Code) int {
+	if status, present := grpcCodeToHttpStatus[code]; present {
+		return status
+	}
+	return http.StatusInternalServerError
+}
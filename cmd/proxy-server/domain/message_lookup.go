@@ -0,0 +1,66 @@
+package domain
+
+import (
+	"fmt"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"sync"
+)
+
+// Messages in a message pact are identified by their description and provider state, in the same way as the Ruby
+// core identifies them when asking the provider to produce a message.
+type MessageLookup struct {
+	messages []serialization.MessageInteraction
+	lock     sync.Mutex
+}
+
+func (ml *MessageLookup) Add(message serialization.MessageInteraction) error {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	for _, existing := range ml.messages {
+		if existing.Description == message.Description && existing.GetProviderState() == message.GetProviderState() {
+			return fmt.Errorf("message %q already registered", message.Description)
+		}
+	}
+	ml.messages = append(ml.messages, message)
+	fmt.Println("Added message: ", message.Description)
+	return nil
+}
+
+// Where the provider state isn't known, the first message registered with the description is chosen.
+func (ml *MessageLookup) Get(description string, providerState string, providerStateKnown bool) (serialization.MessageInteraction, bool) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	for _, message := range ml.messages {
+		if message.Description == description && (!providerStateKnown || message.GetProviderState() == providerState) {
+			return message, true
+		}
+	}
+	return serialization.MessageInteraction{}, false
+}
+
+func (ml *MessageLookup) GetAll() []serialization.MessageInteraction {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+
+	return append([]serialization.MessageInteraction(nil), ml.messages...)
+}
+
+func CreateEmptyMessageLookup() *MessageLookup {
+	return &MessageLookup{
+		messages: []serialization.MessageInteraction{},
+		lock:     sync.Mutex{},
+	}
+}
+
+func CreateMessageLookupFromContract(contract *serialization.PactContract) *MessageLookup {
+	messageLookup := CreateEmptyMessageLookup()
+	for _, message := range contract.Messages {
+		err := messageLookup.Add(message)
+		if err != nil {
+			fmt.Printf("Unable to add message: %v\n", err)
+		}
+	}
+	return messageLookup
+}
@@ -0,0 +1,120 @@
+package encoders
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"gopkg.in/linkedin/goavro.v2"
+)
+
+func init() {
+	Register("avro", avroEncoder{}, func() interface{} { return &AvroEncodingDescription{} })
+}
+
+// Schemas may be given either as a JSON string holding the schema, or as the schema itself. Where a reader schema is
+// given, the JSON form of the body is that of the reader schema: fields the reader doesn't know about are dropped, and
+// those it adds take their defaults. Bodies framed for a schema registry may give only the subject or id of their writer
+// schema, which is then resolved when the interaction is registered.
+type AvroEncodingDescription struct {
+	WriterSchema   json.RawMessage                      `json:"writerSchema,omitempty"`
+	ReaderSchema   json.RawMessage                      `json:"readerSchema,omitempty"`
+	SchemaRegistry *serialization.SchemaRegistryFraming `json:"schemaRegistry,omitempty"`
+}
+
+type avroEncoder struct{}
+
+func (avroEncoder) BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	writer, reader, err := avroCodecs(encoding)
+	if err != nil {
+		return nil, err
+	}
+	if framing := avroFraming(encoding); framing != nil {
+		var schemaId int32
+		schemaId, data, err = readSchemaRegistryFrame(data)
+		if err != nil {
+			return nil, err
+		}
+		// Avro can't be read without the exact schema it was written with
+		if schemaId != framing.SchemaId {
+			return nil, fmt.Errorf("body was written with schema id %d, but the pact's writerSchema is schema id %d",
+				schemaId, framing.SchemaId)
+		}
+	}
+	native, remaining, err := writer.NativeFromBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(remaining) > 0 {
+		return nil, errors.New("unexpected trailing bytes after Avro datum")
+	}
+	return reader.TextualFromNative(nil, native)
+}
+
+func (avroEncoder) JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	writer, reader, err := avroCodecs(encoding)
+	if err != nil {
+		return nil, err
+	}
+	native, _, err := reader.NativeFromTextual(data)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := writer.BinaryFromNative(nil, native)
+	if err != nil {
+		return nil, err
+	}
+	if framing := avroFraming(encoding); framing != nil {
+		return writeSchemaRegistryFrame(framing, binary), nil
+	}
+	return binary, nil
+}
+
+func (avroEncoder) Validate(encoding *serialization.SerializationEncoding, path string) error {
+	_, _, err := avroCodecs(encoding)
+	if err != nil {
+		return err
+	}
+	return validateSchemaRegistryFraming(avroFraming(encoding))
+}
+
+func (avroEncoder) ContentType(encoding *serialization.SerializationEncoding) string {
+	return "avro/binary"
+}
+
+// The reader codec is the writer codec where no reader schema is given.
+func avroCodecs(encoding *serialization.SerializationEncoding) (*goavro.Codec, *goavro.Codec, error) {
+	description, described := encoding.Description.(*AvroEncodingDescription)
+	if !described || len(description.WriterSchema) == 0 {
+		return nil, nil, errors.New("no writerSchema given")
+	}
+	writer, err := avroCodec(description.WriterSchema)
+	if err != nil {
+		return nil, nil, errors.New("invalid writerSchema: " + err.Error())
+	}
+	if len(description.ReaderSchema) == 0 {
+		return writer, writer, nil
+	}
+	reader, err := avroCodec(description.ReaderSchema)
+	if err != nil {
+		return nil, nil, errors.New("invalid readerSchema: " + err.Error())
+	}
+	return writer, reader, nil
+}
+
+func avroFraming(encoding *serialization.SerializationEncoding) *serialization.SchemaRegistryFraming {
+	description, _ := encoding.Description.(*AvroEncodingDescription)
+	if description == nil {
+		return nil
+	}
+	return description.SchemaRegistry
+}
+
+func avroCodec(schema json.RawMessage) (*goavro.Codec, error) {
+	var schemaText string
+	if json.Unmarshal(schema, &schemaText) != nil {
+		schemaText = string(schema)
+	}
+	return goavro.NewCodec(schemaText)
+}
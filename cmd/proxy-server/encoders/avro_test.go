@@ -0,0 +1,82 @@
+package encoders
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+const userSchema = `{"type": "record", "name": "User", "fields": [
+	{"name": "name", "type": "string"},
+	{"name": "email", "type": ["null", "string"], "default": null}]}`
+
+func getAvroEncoding(t *testing.T, description string) *serialization.SerializationEncoding {
+	encoding := &serialization.SerializationEncoding{}
+	err := json.Unmarshal([]byte(`{"type": "avro", "description": `+description+`}`), encoding)
+	if err != nil {
+		panic(err)
+	}
+	encoder, registered := Lookup(encoding)
+	assert.True(t, registered)
+	assert.Equal(t, avroEncoder{}, encoder)
+	return encoding
+}
+
+func TestAvroBodyRoundTripsThroughAvroJson(t *testing.T) {
+	// The schema can be given as a string too
+	quotedSchema, _ := json.Marshal(userSchema)
+	for _, description := range []string{
+		`{"writerSchema": ` + userSchema + `}`,
+		`{"writerSchema": ` + string(quotedSchema) + `}`,
+	} {
+		encoding := getAvroEncoding(t, description)
+
+		binary, err := avroEncoder{}.JsonToBinary(
+			[]byte(`{"name": "Joe Bloggs", "email": {"string": "joe.bloggs@foobarmail.com"}}`), encoding, "/users")
+		assert.Nil(t, err)
+		// Strings are written as a zig-zag length followed by the bytes, and the union as the index of its branch
+		assert.Equal(t, append(append([]byte{20}, "Joe Bloggs"...), append([]byte{2, 50}, "joe.bloggs@foobarmail.com"...)...), binary)
+
+		jsonBytes, err := avroEncoder{}.BinaryToJson(binary, encoding, "/users")
+		assert.Nil(t, err)
+		assert.JSONEq(t, `{"name": "Joe Bloggs", "email": {"string": "joe.bloggs@foobarmail.com"}}`, string(jsonBytes))
+	}
+}
+
+func TestAvroBodyReadWithReaderSchema(t *testing.T) {
+	writerSchema := `{"type": "record", "name": "User", "fields": [
+		{"name": "name", "type": "string"}, {"name": "age", "type": "int"}]}`
+	encoding := getAvroEncoding(t, `{"writerSchema": `+writerSchema+`, "readerSchema": `+userSchema+`}`)
+
+	binary := append(append([]byte{20}, "Joe Bloggs"...), 84)
+	jsonBytes, err := avroEncoder{}.BinaryToJson(binary, encoding, "/users")
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name": "Joe Bloggs", "email": null}`, string(jsonBytes))
+}
+
+func TestAvroBodyNotMatchingSchemaReported(t *testing.T) {
+	encoding := getAvroEncoding(t, `{"writerSchema": `+userSchema+`}`)
+
+	_, err := avroEncoder{}.BinaryToJson(append([]byte{20}, "Joe"...), encoding, "/users")
+	assert.NotNil(t, err)
+	_, err = avroEncoder{}.BinaryToJson(append(append([]byte{6}, "Joe"...), 0, 0), encoding, "/users")
+	assert.EqualError(t, err, "unexpected trailing bytes after Avro datum")
+}
+
+func TestInvalidAvroSchemasReported(t *testing.T) {
+	err := ValidateEncodings("/users", getAvroEncoding(t, `{}`))
+	assert.EqualError(t, err, "invalid avro encoding for /users: no writerSchema given")
+
+	err = ValidateEncodings("/users", getAvroEncoding(t, `{"writerSchema": {"type": "recrd"}}`))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid avro encoding for /users: invalid writerSchema: ")
+	}
+
+	err = ValidateEncodings("/users", getAvroEncoding(t, `{"writerSchema": `+userSchema+`, "readerSchema": "nope"}`))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "invalid avro encoding for /users: invalid readerSchema: ")
+	}
+}
@@ -0,0 +1,372 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+func init() {
+	Register("cbor", cborEncoder{}, nil)
+}
+
+// CBOR bodies need no description. Tagged values, such as dates, are kept as tags rather than being interpreted.
+type cborEncoder struct{}
+
+func (cborEncoder) BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	reader := &schemalessReader{data: data}
+	value, err := readCborValue(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+	if value == cborBreak {
+		return nil, errors.New("unexpected CBOR break")
+	}
+	if reader.remaining() > 0 {
+		return nil, errors.New("unexpected trailing bytes after CBOR value")
+	}
+	return schemalessToJson(value, "CBOR")
+}
+
+func (cborEncoder) JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	value, err := schemalessFromJson(data)
+	if err != nil {
+		return nil, err
+	}
+	writer := &cborWriter{}
+	err = writer.writeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return writer.data, nil
+}
+
+func (cborEncoder) Validate(encoding *serialization.SerializationEncoding, path string) error {
+	return nil
+}
+
+func (cborEncoder) ContentType(encoding *serialization.SerializationEncoding) string {
+	return "application/cbor"
+}
+
+const (
+	cborUnsigned   = 0
+	cborNegative   = 1
+	cborByteString = 2
+	cborTextString = 3
+	cborArray      = 4
+	cborMap        = 5
+	cborTag        = 6
+	cborSimple     = 7
+
+	cborIndefinite = 31
+)
+
+var errCborTruncated = errors.New("unexpected end of CBOR data")
+
+// Returned in place of a value for the "break" which ends an indefinite length item.
+type cborBreakValue struct{}
+
+var cborBreak = cborBreakValue{}
+
+// Reads the argument following an item's initial byte, which is its value, length or tag number.
+func readCborArgument(reader *schemalessReader, info byte) (uint64, error) {
+	if info < 24 {
+		return uint64(info), nil
+	}
+	if info > 27 {
+		return 0, fmt.Errorf("invalid CBOR additional information %d", info)
+	}
+	data, ok := reader.take(1 << (info - 24))
+	if !ok {
+		return 0, errCborTruncated
+	}
+	argument := uint64(0)
+	for _, b := range data {
+		argument = argument<<8 | uint64(b)
+	}
+	return argument, nil
+}
+
+func readCborValue(reader *schemalessReader, depth int) (interface{}, error) {
+	if depth > maxSchemalessDepth {
+		return nil, errors.New("CBOR data nested too deeply")
+	}
+	header, ok := reader.take(1)
+	if !ok {
+		return nil, errCborTruncated
+	}
+	majorType := header[0] >> 5
+	info := header[0] & 0x1f
+
+	if info == cborIndefinite {
+		switch majorType {
+		case cborByteString, cborTextString:
+			return readIndefiniteCborString(reader, majorType)
+		case cborArray:
+			return readCborArray(reader, 0, true, depth)
+		case cborMap:
+			return readCborMap(reader, 0, true, depth)
+		case cborSimple:
+			return cborBreak, nil
+		}
+		return nil, fmt.Errorf("CBOR major type %d can't have an indefinite length", majorType)
+	}
+	if majorType == cborSimple {
+		return readCborSimple(reader, info)
+	}
+
+	argument, err := readCborArgument(reader, info)
+	if err != nil {
+		return nil, err
+	}
+	switch majorType {
+	case cborUnsigned:
+		if argument > math.MaxInt64 {
+			return argument, nil
+		}
+		return int64(argument), nil
+	case cborNegative:
+		if argument > math.MaxInt64 {
+			return nil, fmt.Errorf("CBOR negative integer -1-%d is too small for a 64-bit integer", argument)
+		}
+		return -1 - int64(argument), nil
+	case cborByteString, cborTextString:
+		data, ok := reader.take(argument)
+		if !ok {
+			return nil, errCborTruncated
+		}
+		if majorType == cborTextString {
+			return string(data), nil
+		}
+		return append([]byte(nil), data...), nil
+	case cborArray:
+		return readCborArray(reader, argument, false, depth)
+	case cborMap:
+		return readCborMap(reader, argument, false, depth)
+	}
+
+	content, err := readCborValue(reader, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	if content == cborBreak {
+		return nil, errors.New("unexpected CBOR break")
+	}
+	return schemalessTag{number: argument, content: content}, nil
+}
+
+// Indefinite length strings are a series of definite length chunks of the same type, ended by a break.
+func readIndefiniteCborString(reader *schemalessReader, majorType byte) (interface{}, error) {
+	var data []byte
+	for {
+		header, ok := reader.take(1)
+		if !ok {
+			return nil, errCborTruncated
+		}
+		if header[0] == 0xff {
+			break
+		}
+		if header[0]>>5 != majorType || header[0]&0x1f == cborIndefinite {
+			return nil, fmt.Errorf("invalid chunk in indefinite length CBOR string: 0x%x", header[0])
+		}
+		length, err := readCborArgument(reader, header[0]&0x1f)
+		if err != nil {
+			return nil, err
+		}
+		chunk, ok := reader.take(length)
+		if !ok {
+			return nil, errCborTruncated
+		}
+		data = append(data, chunk...)
+	}
+	if majorType == cborTextString {
+		return string(data), nil
+	}
+	if data == nil {
+		data = []byte{}
+	}
+	return data, nil
+}
+
+// Undefined is read as null, as JSON has no equivalent.
+func readCborSimple(reader *schemalessReader, info byte) (interface{}, error) {
+	switch info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23:
+		return nil, nil
+	case 25:
+		bits, err := readCborArgument(reader, info)
+		return halfToFloat64(uint16(bits)), err
+	case 26:
+		bits, err := readCborArgument(reader, info)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 27:
+		bits, err := readCborArgument(reader, info)
+		return math.Float64frombits(bits), err
+	}
+	return nil, fmt.Errorf("unsupported CBOR simple value %d", info)
+}
+
+func halfToFloat64(bits uint16) float64 {
+	exponent := int(bits>>10) & 0x1f
+	mantissa := float64(bits & 0x3ff)
+	var value float64
+	switch exponent {
+	case 0:
+		value = math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mantissa+1024, exponent-25)
+	}
+	if bits&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+func readCborArray(reader *schemalessReader, size uint64, indefinite bool, depth int) (interface{}, error) {
+	if !indefinite && !reader.hasElements(size) {
+		return nil, errCborTruncated
+	}
+	elems := make([]interface{}, 0, size)
+	for i := uint64(0); indefinite || i < size; i++ {
+		elem, err := readCborValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if elem == cborBreak {
+			if !indefinite {
+				return nil, errors.New("unexpected CBOR break")
+			}
+			break
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+func readCborMap(reader *schemalessReader, size uint64, indefinite bool, depth int) (interface{}, error) {
+	if !indefinite && !reader.hasElements(size) {
+		return nil, errCborTruncated
+	}
+	entries := make([]schemalessMapEntry, 0, size)
+	for i := uint64(0); indefinite || i < size; i++ {
+		key, err := readCborValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if key == cborBreak {
+			if !indefinite {
+				return nil, errors.New("unexpected CBOR break")
+			}
+			break
+		}
+		value, err := readCborValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		if value == cborBreak {
+			return nil, errors.New("unexpected CBOR break")
+		}
+		entries = append(entries, schemalessMapEntry{key: key, value: value})
+	}
+	return entries, nil
+}
+
+type cborWriter struct {
+	data []byte
+}
+
+// Writes an item's initial byte and argument, using the shortest encoding of the argument.
+func (w *cborWriter) writeHead(majorType byte, argument uint64) {
+	size := 0
+	switch {
+	case argument < 24:
+		w.data = append(w.data, majorType<<5|byte(argument))
+		return
+	case argument <= math.MaxUint8:
+		size = 1
+	case argument <= math.MaxUint16:
+		size = 2
+	case argument <= math.MaxUint32:
+		size = 4
+	default:
+		size = 8
+	}
+	info := map[int]byte{1: 24, 2: 25, 4: 26, 8: 27}[size]
+	w.data = append(w.data, majorType<<5|info)
+	for i := size - 1; i >= 0; i-- {
+		w.data = append(w.data, byte(argument>>(8*uint(i))))
+	}
+}
+
+func (w *cborWriter) writeValue(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		w.data = append(w.data, 0xf6)
+	case bool:
+		if v {
+			w.data = append(w.data, 0xf5)
+		} else {
+			w.data = append(w.data, 0xf4)
+		}
+	case int64:
+		if v >= 0 {
+			w.writeHead(cborUnsigned, uint64(v))
+		} else {
+			w.writeHead(cborNegative, uint64(-1-v))
+		}
+	case uint64:
+		w.writeHead(cborUnsigned, v)
+	case float64:
+		w.data = append(w.data, 0xfb)
+		bits := math.Float64bits(v)
+		for i := 7; i >= 0; i-- {
+			w.data = append(w.data, byte(bits>>(8*uint(i))))
+		}
+	case string:
+		w.writeHead(cborTextString, uint64(len(v)))
+		w.data = append(w.data, v...)
+	case []byte:
+		w.writeHead(cborByteString, uint64(len(v)))
+		w.data = append(w.data, v...)
+	case []interface{}:
+		w.writeHead(cborArray, uint64(len(v)))
+		for _, elem := range v {
+			err := w.writeValue(elem)
+			if err != nil {
+				return err
+			}
+		}
+	case []schemalessMapEntry:
+		w.writeHead(cborMap, uint64(len(v)))
+		for _, entry := range v {
+			err := w.writeValue(entry.key)
+			if err == nil {
+				err = w.writeValue(entry.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case schemalessTag:
+		w.writeHead(cborTag, v.number)
+		return w.writeValue(v.content)
+	case schemalessExt:
+		return fmt.Errorf("MessagePack extension type %d can't be written as CBOR", v.extType)
+	default:
+		return fmt.Errorf("unsupported value %v", value)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package encoders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCborBodyRoundTrip(t *testing.T) {
+	for jsonBody, data := range map[string][]byte{
+		`{"id": 5, "name": "Jo"}`:                          {0xa2, 0x62, 'i', 'd', 5, 0x64, 'n', 'a', 'm', 'e', 0x62, 'J', 'o'},
+		`{"avatar": {"$bytes": "AQI="}}`:                   {0xa1, 0x66, 'a', 'v', 'a', 't', 'a', 'r', 0x42, 1, 2},
+		`[-1, -500, 24, 1.5, false, null]`:                 {0x86, 0x20, 0x39, 0x01, 0xf3, 0x18, 24, 0xfb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xf4, 0xf6},
+		`{"$map": [[1, "one"], [{"$bytes": "Ag=="}, 2]]}`:  {0xa2, 1, 0x63, 'o', 'n', 'e', 0x41, 2, 2},
+		`{"$tag": {"number": 1, "value": 1363896240}}`:     {0xc1, 0x1a, 0x51, 0x4b, 0x67, 0xb0},
+		`{"$tag": {"number": 32, "value": "http://x.io"}}`: {0xd8, 32, 0x6b, 'h', 't', 't', 'p', ':', '/', '/', 'x', '.', 'i', 'o'},
+		`18446744073709551615`:                             {0x1b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		encoded, err := cborEncoder{}.JsonToBinary([]byte(jsonBody), nil, "/sensors")
+		assert.Nil(t, err, jsonBody)
+		assert.Equal(t, data, encoded, jsonBody)
+
+		decoded, err := cborEncoder{}.BinaryToJson(data, nil, "/sensors")
+		assert.Nil(t, err, jsonBody)
+		assert.JSONEq(t, jsonBody, string(decoded))
+	}
+}
+
+func TestCborIndefiniteLengthsAndSmallFloatsDecoded(t *testing.T) {
+	decoded, err := cborEncoder{}.BinaryToJson([]byte{
+		0xbf,
+		0x63, 'a', 'r', 'r', 0x9f, 1, 2, 0xff,
+		0x63, 's', 't', 'r', 0x7f, 0x62, 'J', 'o', 0x61, '!', 0xff,
+		0x63, 'b', 'i', 'n', 0x5f, 0x41, 1, 0x41, 2, 0xff,
+		0x64, 'h', 'a', 'l', 'f', 0xf9, 0x3e, 0x00,
+		0x65, 'f', 'l', 'o', 'a', 't', 0xfa, 0x3f, 0xc0, 0, 0,
+		0x63, 'u', 'n', 'd', 0xf7,
+		0xff}, nil, "/sensors")
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"arr": [1, 2], "str": "Jo!", "bin": {"$bytes": "AQI="}, "half": 1.5, "float": 1.5, "und": null}`,
+		string(decoded))
+}
+
+func TestInvalidCborReported(t *testing.T) {
+	for _, data := range [][]byte{{0x63, 'J', 'o'}, {0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, {0x9f, 1}} {
+		_, err := cborEncoder{}.BinaryToJson(data, nil, "/sensors")
+		assert.EqualError(t, err, "unexpected end of CBOR data")
+	}
+
+	_, err := cborEncoder{}.BinaryToJson([]byte{0x82, 1, 0xff}, nil, "/sensors")
+	assert.EqualError(t, err, "unexpected CBOR break")
+
+	_, err = cborEncoder{}.BinaryToJson([]byte{0x3b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, nil, "/sensors")
+	assert.EqualError(t, err, "CBOR negative integer -1-18446744073709551615 is too small for a 64-bit integer")
+
+	_, err = cborEncoder{}.BinaryToJson([]byte{0x1c}, nil, "/sensors")
+	assert.EqualError(t, err, "invalid CBOR additional information 28")
+
+	_, err = cborEncoder{}.BinaryToJson([]byte{0xf9, 0x7c, 0x00}, nil, "/sensors")
+	assert.EqualError(t, err, "$: +Inf can't be written as JSON")
+
+	_, err = cborEncoder{}.JsonToBinary([]byte(`{"$ext": {"type": 5, "data": "Bw=="}}`), nil, "/sensors")
+	assert.EqualError(t, err, "MessagePack extension type 5 can't be written as CBOR")
+}
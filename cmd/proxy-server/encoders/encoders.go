@@ -0,0 +1,108 @@
+package encoders
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Converts bodies in a binary encoding to and from the JSON which the Ruby core works with. The path is that of the
+// interaction (or the description of the message) which the body belongs to.
+type Encoder interface {
+	BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error)
+	JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error)
+	// Checks the encoding's description when an interaction is registered, so that mistakes in it are reported to
+	// the consumer test rather than when the body is first converted.
+	Validate(encoding *serialization.SerializationEncoding, path string) error
+	// The content type of the binary form of the body.
+	ContentType(encoding *serialization.SerializationEncoding) string
+}
+
+// Encoders whose bodies are protobuf messages implement this too, so that mismatches can be reported by field.
+type MessageDescriptorEncoder interface {
+	MessageDescriptor(encoding *serialization.SerializationEncoding, path string) (*desc.MessageDescriptor, error)
+}
+
+var (
+	registeredEncoders     = map[string]Encoder{}
+	registeredEncodersLock sync.RWMutex
+)
+
+// Registers the encoder for the given `Type` of encoding. Descriptions of the encoding are decoded into the value
+// returned by newDescription, or kept as raw JSON if it's nil. The returned function restores whatever was registered
+// for the type before, which is mostly of use to tests.
+func Register(encodingType string, encoder Encoder, newDescription func() interface{}) (unregister func()) {
+	registeredEncodersLock.Lock()
+	previous, wasRegistered := registeredEncoders[encodingType]
+	registeredEncoders[encodingType] = encoder
+	registeredEncodersLock.Unlock()
+
+	unregisterDescription := func() {}
+	if newDescription != nil {
+		unregisterDescription = serialization.RegisterEncodingDescription(encodingType, newDescription)
+	}
+	return func() {
+		unregisterDescription()
+		registeredEncodersLock.Lock()
+		defer registeredEncodersLock.Unlock()
+		if wasRegistered {
+			registeredEncoders[encodingType] = previous
+		} else {
+			delete(registeredEncoders, encodingType)
+		}
+	}
+}
+
+// Bodies without an encoding, or whose encoding has no registered encoder, are passed through as they are.
+func Lookup(encoding *serialization.SerializationEncoding) (Encoder, bool) {
+	if encoding == nil || encoding.Type == "" {
+		return nil, false
+	}
+	registeredEncodersLock.RLock()
+	defer registeredEncodersLock.RUnlock()
+	encoder, registered := registeredEncoders[encoding.Type]
+	return encoder, registered
+}
+
+// Checks each encoding given has a registered encoder, and a valid description.
+func ValidateEncodings(path string, encodings ...*serialization.SerializationEncoding) error {
+	for _, encoding := range encodings {
+		if encoding == nil {
+			continue
+		}
+		encoder, registered := Lookup(encoding)
+		if !registered {
+			return fmt.Errorf("unknown encoding type %q for %s, expected one of: %s",
+				encoding.Type, path, strings.Join(registeredTypes(), ", "))
+		}
+		err := encoder.Validate(encoding, path)
+		if err != nil {
+			return fmt.Errorf("invalid %s encoding for %s: %v", encoding.Type, path, err)
+		}
+	}
+	return nil
+}
+
+// The descriptor of the body's message, or nil where the encoder doesn't use protobuf descriptors.
+func MessageDescriptor(encoder Encoder, encoding *serialization.SerializationEncoding, path string) (*desc.MessageDescriptor, error) {
+	descriptorEncoder, hasDescriptors := encoder.(MessageDescriptorEncoder)
+	if !hasDescriptors {
+		return nil, nil
+	}
+	return descriptorEncoder.MessageDescriptor(encoding, path)
+}
+
+func registeredTypes() []string {
+	registeredEncodersLock.RLock()
+	defer registeredEncodersLock.RUnlock()
+	types := make([]string, 0, len(registeredEncoders))
+	for encodingType := range registeredEncoders {
+		types = append(types, encodingType)
+	}
+	sort.Strings(types)
+	return types
+}
@@ -0,0 +1,33 @@
+package encoders
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingDescription struct {
+	Count int `json:"count"`
+}
+
+func TestUnregisterRestoresPreviousEncoder(t *testing.T) {
+	unregister := Register("cbor", msgpackEncoder{}, func() interface{} { return &countingDescription{} })
+
+	encoding := &serialization.SerializationEncoding{}
+	assert.Nil(t, json.Unmarshal([]byte(`{"type": "cbor", "description": {"count": 2}}`), encoding))
+	assert.Equal(t, &countingDescription{Count: 2}, encoding.Description)
+	encoder, _ := Lookup(encoding)
+	assert.Equal(t, msgpackEncoder{}, encoder)
+
+	unregister()
+	assert.Nil(t, json.Unmarshal([]byte(`{"type": "cbor", "description": {"count": 2}}`), encoding))
+	assert.Equal(t, json.RawMessage(`{"count": 2}`), encoding.Description)
+	encoder, _ = Lookup(encoding)
+	assert.Equal(t, cborEncoder{}, encoder)
+
+	unregister = Register("yaml", cborEncoder{}, nil)
+	unregister()
+	assert.Equal(t, []string{"avro", "cbor", "msgpack", "protobuf", "thrift"}, registeredTypes())
+}
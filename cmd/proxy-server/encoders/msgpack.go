@@ -0,0 +1,323 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+func init() {
+	Register("msgpack", msgpackEncoder{}, nil)
+}
+
+// MessagePack bodies need no description. Integers are written in their smallest form, and numbers which aren't
+// integers as 64-bit floats.
+type msgpackEncoder struct{}
+
+func (msgpackEncoder) BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	reader := &schemalessReader{data: data}
+	value, err := readMsgpackValue(reader, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.remaining() > 0 {
+		return nil, errors.New("unexpected trailing bytes after MessagePack value")
+	}
+	return schemalessToJson(value, "MessagePack")
+}
+
+func (msgpackEncoder) JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	value, err := schemalessFromJson(data)
+	if err != nil {
+		return nil, err
+	}
+	writer := &msgpackWriter{}
+	err = writer.writeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return writer.data, nil
+}
+
+func (msgpackEncoder) Validate(encoding *serialization.SerializationEncoding, path string) error {
+	return nil
+}
+
+func (msgpackEncoder) ContentType(encoding *serialization.SerializationEncoding) string {
+	return "application/msgpack"
+}
+
+var errMsgpackTruncated = errors.New("unexpected end of MessagePack data")
+
+func readMsgpackUint(reader *schemalessReader, size int) (uint64, error) {
+	data, ok := reader.take(uint64(size))
+	if !ok {
+		return 0, errMsgpackTruncated
+	}
+	value := uint64(0)
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func readMsgpackValue(reader *schemalessReader, depth int) (interface{}, error) {
+	if depth > maxSchemalessDepth {
+		return nil, errors.New("MessagePack data nested too deeply")
+	}
+	header, ok := reader.take(1)
+	if !ok {
+		return nil, errMsgpackTruncated
+	}
+	c := header[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return readMsgpackMap(reader, uint64(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return readMsgpackArray(reader, uint64(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		return readMsgpackBytes(reader, uint64(c&0x1f), true)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		sizeBytes := map[byte]int{0xc4: 1, 0xc5: 2, 0xc6: 4, 0xd9: 1, 0xda: 2, 0xdb: 4}[c]
+		size, err := readMsgpackUint(reader, sizeBytes)
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackBytes(reader, size, c >= 0xd9)
+	case 0xc7, 0xc8, 0xc9:
+		size, err := readMsgpackUint(reader, map[byte]int{0xc7: 1, 0xc8: 2, 0xc9: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(reader, size)
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(reader, uint64(1)<<(c-0xd4))
+	case 0xca:
+		bits, err := readMsgpackUint(reader, 4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := readMsgpackUint(reader, 8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		value, err := readMsgpackUint(reader, 1<<(c-0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if value > math.MaxInt64 {
+			return value, nil
+		}
+		return int64(value), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		value, err := readMsgpackUint(reader, size)
+		if err != nil {
+			return nil, err
+		}
+		// Sign-extend from the integer's size
+		shift := uint(64 - 8*size)
+		return int64(value<<shift) >> shift, nil
+	case 0xdc, 0xdd:
+		size, err := readMsgpackUint(reader, map[byte]int{0xdc: 2, 0xdd: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(reader, size, depth)
+	case 0xde, 0xdf:
+		size, err := readMsgpackUint(reader, map[byte]int{0xde: 2, 0xdf: 4}[c])
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(reader, size, depth)
+	}
+	return nil, fmt.Errorf("invalid MessagePack type 0x%x", c)
+}
+
+// Strings are returned as strings, and binary values as byte slices.
+func readMsgpackBytes(reader *schemalessReader, size uint64, isString bool) (interface{}, error) {
+	data, ok := reader.take(size)
+	if !ok {
+		return nil, errMsgpackTruncated
+	}
+	if isString {
+		return string(data), nil
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func readMsgpackExt(reader *schemalessReader, size uint64) (interface{}, error) {
+	extType, ok := reader.take(1)
+	if !ok {
+		return nil, errMsgpackTruncated
+	}
+	data, ok := reader.take(size)
+	if !ok {
+		return nil, errMsgpackTruncated
+	}
+	return schemalessExt{extType: int8(extType[0]), data: append([]byte(nil), data...)}, nil
+}
+
+func readMsgpackArray(reader *schemalessReader, size uint64, depth int) (interface{}, error) {
+	if !reader.hasElements(size) {
+		return nil, errMsgpackTruncated
+	}
+	elems := make([]interface{}, 0, size)
+	for i := uint64(0); i < size; i++ {
+		elem, err := readMsgpackValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+	}
+	return elems, nil
+}
+
+func readMsgpackMap(reader *schemalessReader, size uint64, depth int) (interface{}, error) {
+	if !reader.hasElements(size) {
+		return nil, errMsgpackTruncated
+	}
+	entries := make([]schemalessMapEntry, 0, size)
+	for i := uint64(0); i < size; i++ {
+		key, err := readMsgpackValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readMsgpackValue(reader, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, schemalessMapEntry{key: key, value: value})
+	}
+	return entries, nil
+}
+
+type msgpackWriter struct {
+	data []byte
+}
+
+func (w *msgpackWriter) writeUint(c byte, value uint64, size int) {
+	w.data = append(w.data, c)
+	for i := size - 1; i >= 0; i-- {
+		w.data = append(w.data, byte(value>>(8*uint(i))))
+	}
+}
+
+// Lengths are written with the smallest of the given 8, 16 and 32-bit headers; arrays and maps have no 8-bit header.
+func (w *msgpackWriter) writeLength(length int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case length <= math.MaxUint8 && code8 != 0:
+		w.writeUint(code8, uint64(length), 1)
+	case length <= math.MaxUint16:
+		w.writeUint(code16, uint64(length), 2)
+	default:
+		w.writeUint(code32, uint64(length), 4)
+	}
+}
+
+func (w *msgpackWriter) writeValue(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		w.data = append(w.data, 0xc0)
+	case bool:
+		if v {
+			w.data = append(w.data, 0xc3)
+		} else {
+			w.data = append(w.data, 0xc2)
+		}
+	case int64:
+		w.writeInt(v)
+	case uint64:
+		w.writeUint(0xcf, v, 8)
+	case float64:
+		w.writeUint(0xcb, math.Float64bits(v), 8)
+	case string:
+		if len(v) < 32 {
+			w.data = append(w.data, 0xa0|byte(len(v)))
+		} else {
+			w.writeLength(len(v), 0xd9, 0xda, 0xdb)
+		}
+		w.data = append(w.data, v...)
+	case []byte:
+		w.writeLength(len(v), 0xc4, 0xc5, 0xc6)
+		w.data = append(w.data, v...)
+	case []interface{}:
+		if len(v) < 16 {
+			w.data = append(w.data, 0x90|byte(len(v)))
+		} else {
+			w.writeLength(len(v), 0, 0xdc, 0xdd)
+		}
+		for _, elem := range v {
+			err := w.writeValue(elem)
+			if err != nil {
+				return err
+			}
+		}
+	case []schemalessMapEntry:
+		if len(v) < 16 {
+			w.data = append(w.data, 0x80|byte(len(v)))
+		} else {
+			w.writeLength(len(v), 0, 0xde, 0xdf)
+		}
+		for _, entry := range v {
+			err := w.writeValue(entry.key)
+			if err == nil {
+				err = w.writeValue(entry.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	case schemalessExt:
+		if fixExt := map[int]byte{1: 0xd4, 2: 0xd5, 4: 0xd6, 8: 0xd7, 16: 0xd8}[len(v.data)]; fixExt != 0 {
+			w.data = append(w.data, fixExt)
+		} else {
+			w.writeLength(len(v.data), 0xc7, 0xc8, 0xc9)
+		}
+		w.data = append(w.data, byte(v.extType))
+		w.data = append(w.data, v.data...)
+	case schemalessTag:
+		return fmt.Errorf("CBOR tag %d can't be written as MessagePack", v.number)
+	default:
+		return fmt.Errorf("unsupported value %v", value)
+	}
+	return nil
+}
+
+func (w *msgpackWriter) writeInt(value int64) {
+	switch {
+	case value >= 0 && value <= math.MaxInt8:
+		w.data = append(w.data, byte(value))
+	case value >= -32 && value < 0:
+		w.data = append(w.data, byte(int8(value)))
+	case value >= 0 && value <= math.MaxUint8:
+		w.writeUint(0xcc, uint64(value), 1)
+	case value >= 0 && value <= math.MaxUint16:
+		w.writeUint(0xcd, uint64(value), 2)
+	case value >= 0 && value <= math.MaxUint32:
+		w.writeUint(0xce, uint64(value), 4)
+	case value >= 0:
+		w.writeUint(0xcf, uint64(value), 8)
+	case value >= math.MinInt8:
+		w.writeUint(0xd0, uint64(value), 1)
+	case value >= math.MinInt16:
+		w.writeUint(0xd1, uint64(value), 2)
+	case value >= math.MinInt32:
+		w.writeUint(0xd2, uint64(value), 4)
+	default:
+		w.writeUint(0xd3, uint64(value), 8)
+	}
+}
@@ -0,0 +1,56 @@
+package encoders
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgpackBodyRoundTrip(t *testing.T) {
+	for jsonBody, data := range map[string][]byte{
+		`{"id": 5, "name": "Jo"}`:                {0x82, 0xa2, 'i', 'd', 5, 0xa4, 'n', 'a', 'm', 'e', 0xa2, 'J', 'o'},
+		`{"avatar": {"$bytes": "AQI="}}`:         {0x81, 0xa6, 'a', 'v', 'a', 't', 'a', 'r', 0xc4, 2, 1, 2},
+		`[-1, -33, 300, 1.5, true, null]`:        {0x96, 0xff, 0xd0, 0xdf, 0xcd, 0x01, 0x2c, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0, 0xc3, 0xc0},
+		`{"$map": [[1, "one"], [[2], "two"]]}`:   {0x82, 1, 0xa3, 'o', 'n', 'e', 0x91, 2, 0xa3, 't', 'w', 'o'},
+		`{"$ext": {"type": 5, "data": "Bw=="}}`:  {0xd4, 5, 7},
+		`{"$ext": {"type": -1, "data": "AQID"}}`: {0xc7, 3, 0xff, 1, 2, 3},
+		`{"$map": [["$price", 10]]}`:             {0x81, 0xa6, '$', 'p', 'r', 'i', 'c', 'e', 10},
+		`18446744073709551615`:                   {0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	} {
+		encoded, err := msgpackEncoder{}.JsonToBinary([]byte(jsonBody), nil, "/users")
+		assert.Nil(t, err, jsonBody)
+		assert.Equal(t, data, encoded, jsonBody)
+
+		decoded, err := msgpackEncoder{}.BinaryToJson(data, nil, "/users")
+		assert.Nil(t, err, jsonBody)
+		assert.JSONEq(t, jsonBody, string(decoded))
+	}
+}
+
+func TestMsgpackLongerFormsDecoded(t *testing.T) {
+	// A str8 string, an int32 and a float32 in an array16, which a smaller encoding could have been used for
+	decoded, err := msgpackEncoder{}.BinaryToJson([]byte{0xdc, 0, 3, 0xd9, 2, 'J', 'o', 0xd2, 0xff, 0xff, 0xff, 0xfe,
+		0xca, 0x3f, 0xc0, 0, 0}, nil, "/users")
+
+	assert.Nil(t, err)
+	assert.JSONEq(t, `["Jo", -2, 1.5]`, string(decoded))
+}
+
+func TestInvalidMsgpackReported(t *testing.T) {
+	for _, data := range [][]byte{{0xa3, 'J', 'o'}, {0xdd, 0xff, 0xff, 0xff, 0xff}, {0xc4}} {
+		_, err := msgpackEncoder{}.BinaryToJson(data, nil, "/users")
+		assert.EqualError(t, err, "unexpected end of MessagePack data")
+	}
+
+	_, err := msgpackEncoder{}.BinaryToJson([]byte{1, 2}, nil, "/users")
+	assert.EqualError(t, err, "unexpected trailing bytes after MessagePack value")
+
+	_, err = msgpackEncoder{}.BinaryToJson([]byte{0xc1}, nil, "/users")
+	assert.EqualError(t, err, "invalid MessagePack type 0xc1")
+
+	_, err = msgpackEncoder{}.JsonToBinary([]byte(`{"$tag": {"number": 1, "value": 0}}`), nil, "/users")
+	assert.EqualError(t, err, "CBOR tag 1 can't be written as MessagePack")
+
+	_, err = msgpackEncoder{}.JsonToBinary([]byte(`{"$bits": "AQI="}`), nil, "/users")
+	assert.EqualError(t, err, "$: unknown marker $bits, expected one of $bytes, $map, $ext or $tag")
+}
@@ -0,0 +1,101 @@
+package encoders
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+func init() {
+	Register("protobuf", protobufEncoder{}, func() interface{} { return &serialization.ProtobufEncodingDescription{} })
+}
+
+type protobufEncoder struct{}
+
+func (protobufEncoder) BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	msgDescriptor, err := descriptorlogic.GetMessageDescriptorFromBody(encoding, path)
+	if err != nil {
+		return nil, err
+	}
+	if framing := encoding.GetProtobufDescription().SchemaRegistry; framing != nil {
+		data, err = readProtobufSchemaRegistryFrame(framing, msgDescriptor, data, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return descriptorlogic.ProtobufBytesToJsonBytes(data, msgDescriptor)
+}
+
+func (protobufEncoder) JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	msgDescriptor, err := descriptorlogic.GetMessageDescriptorFromBody(encoding, path)
+	if err != nil {
+		return nil, err
+	}
+	binary, err := descriptorlogic.JsonBytesToProtobufBytes(data, msgDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	if framing := encoding.GetProtobufDescription().SchemaRegistry; framing != nil {
+		header := writeProtobufMessageIndexes(protobufMessageIndexes(msgDescriptor))
+		return writeSchemaRegistryFrame(framing, append(header, binary...)), nil
+	}
+	return binary, nil
+}
+
+// gRPC interactions needn't name their message, as it's taken from the method instead.
+func (protobufEncoder) Validate(encoding *serialization.SerializationEncoding, path string) error {
+	description := encoding.GetProtobufDescription()
+	if description == nil {
+		return errors.New("no description given")
+	}
+	if description.SchemaRegistry != nil {
+		if description.MessageName == "" {
+			return errors.New("schemaRegistry framing needs a messageName")
+		}
+		err := validateSchemaRegistryFraming(description.SchemaRegistry)
+		if err != nil {
+			return err
+		}
+	}
+	if description.MessageName == "" {
+		_, err := descriptorlogic.GetMethodDescriptorFromBody(encoding, path)
+		return err
+	}
+	_, err := descriptorlogic.GetMessageDescriptorFromBody(encoding, path)
+	return err
+}
+
+func (protobufEncoder) ContentType(encoding *serialization.SerializationEncoding) string {
+	return "application/octet-stream"
+}
+
+func (protobufEncoder) MessageDescriptor(encoding *serialization.SerializationEncoding, path string) (*desc.MessageDescriptor, error) {
+	return descriptorlogic.GetMessageDescriptorFromBody(encoding, path)
+}
+
+// Unlike Avro, protobuf can be read with a different version of the schema to that it was written with, so a body
+// written with a newer schema than the pact's is read with the pact's.
+func readProtobufSchemaRegistryFrame(framing *serialization.SchemaRegistryFraming, msgDescriptor *desc.MessageDescriptor,
+	data []byte, path string) ([]byte, error) {
+	schemaId, data, err := readSchemaRegistryFrame(data)
+	if err != nil {
+		return nil, err
+	}
+	if schemaId != framing.SchemaId {
+		fmt.Printf("Body for %s was written with schema id %d, and is read with the pact's schema id %d\n",
+			path, schemaId, framing.SchemaId)
+	}
+	indexes, data, err := readProtobufMessageIndexes(data)
+	if err != nil {
+		return nil, err
+	}
+	expected := protobufMessageIndexes(msgDescriptor)
+	if fmt.Sprint(indexes) != fmt.Sprint(expected) {
+		return nil, fmt.Errorf("body has message indexes %v, but %s has message indexes %v",
+			indexes, msgDescriptor.GetFullyQualifiedName(), expected)
+	}
+	return data, nil
+}
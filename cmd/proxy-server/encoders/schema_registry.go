@@ -0,0 +1,270 @@
+package encoders
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// A schema as the registry returns it. The schema type is empty for Avro schemas.
+type RegisteredSchema struct {
+	Subject    string            `json:"subject"`
+	Version    int               `json:"version"`
+	Id         int32             `json:"id"`
+	SchemaType string            `json:"schemaType"`
+	Schema     string            `json:"schema"`
+	References []SchemaReference `json:"references"`
+}
+
+// Protobuf schemas refer to the files they import by the name they're imported as.
+type SchemaReference struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Version int    `json:"version"`
+}
+
+// Resolves the schemas of encodings framed for a schema registry, when their interactions are registered.
+type SchemaRegistry interface {
+	SchemaById(id int32) (*RegisteredSchema, error)
+	LatestSchema(subject string) (*RegisteredSchema, error)
+	SchemaVersion(subject string, version int) (*RegisteredSchema, error)
+}
+
+type schemaRegistryClient struct {
+	url    string
+	client *http.Client
+}
+
+// Credentials can be given in the URL, as for basic auth.
+func NewSchemaRegistryClient(registryUrl string) SchemaRegistry {
+	return &schemaRegistryClient{
+		url:    strings.TrimSuffix(registryUrl, "/"),
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (registry *schemaRegistryClient) SchemaById(id int32) (*RegisteredSchema, error) {
+	schema, err := registry.get(fmt.Sprintf("/schemas/ids/%d", id))
+	if err != nil {
+		return nil, err
+	}
+	// Only the schema itself is returned when looking it up by id
+	schema.Id = id
+	return schema, nil
+}
+
+func (registry *schemaRegistryClient) LatestSchema(subject string) (*RegisteredSchema, error) {
+	return registry.get("/subjects/" + url.PathEscape(subject) + "/versions/latest")
+}
+
+func (registry *schemaRegistryClient) SchemaVersion(subject string, version int) (*RegisteredSchema, error) {
+	return registry.get(fmt.Sprintf("/subjects/%s/versions/%d", url.PathEscape(subject), version))
+}
+
+func (registry *schemaRegistryClient) get(path string) (*RegisteredSchema, error) {
+	req, err := http.NewRequest("GET", registry.url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("schema registry returned %d for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+	}
+	schema := &RegisteredSchema{}
+	err = json.Unmarshal(body, schema)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read schema registry response for %s: %v", path, err)
+	}
+	return schema, nil
+}
+
+// Schemas kept in a directory, each in a .json file in the form the registry returns a subject's version, e.g. as saved
+// from /subjects/<subject>/versions/latest.
+type schemaDirectory struct {
+	byId      map[int32]*RegisteredSchema
+	bySubject map[string]map[int]*RegisteredSchema
+}
+
+func LoadSchemaDirectory(directory string) (SchemaRegistry, error) {
+	schemas := &schemaDirectory{
+		byId:      map[int32]*RegisteredSchema{},
+		bySubject: map[string]map[int]*RegisteredSchema{},
+	}
+	err := filepath.Walk(directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".json" {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		schema := &RegisteredSchema{}
+		err = json.Unmarshal(data, schema)
+		if err != nil {
+			return fmt.Errorf("unable to read schema %s: %v", path, err)
+		}
+		if schema.Subject == "" || schema.Id == 0 || schema.Schema == "" {
+			return fmt.Errorf("schema %s needs a subject, id and schema", path)
+		}
+		schemas.byId[schema.Id] = schema
+		if schemas.bySubject[schema.Subject] == nil {
+			schemas.bySubject[schema.Subject] = map[int]*RegisteredSchema{}
+		}
+		schemas.bySubject[schema.Subject][schema.Version] = schema
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return schemas, nil
+}
+
+func (schemas *schemaDirectory) SchemaById(id int32) (*RegisteredSchema, error) {
+	schema, found := schemas.byId[id]
+	if !found {
+		return nil, fmt.Errorf("schema id %d not found in the schema directory", id)
+	}
+	return schema, nil
+}
+
+func (schemas *schemaDirectory) LatestSchema(subject string) (*RegisteredSchema, error) {
+	var latest *RegisteredSchema
+	for _, schema := range schemas.bySubject[subject] {
+		if latest == nil || schema.Version > latest.Version {
+			latest = schema
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("subject %q not found in the schema directory", subject)
+	}
+	return latest, nil
+}
+
+func (schemas *schemaDirectory) SchemaVersion(subject string, version int) (*RegisteredSchema, error) {
+	schema, found := schemas.bySubject[subject][version]
+	if !found {
+		return nil, fmt.Errorf("version %d of subject %q not found in the schema directory", version, subject)
+	}
+	return schema, nil
+}
+
+// Fills in the schema id of any encodings framed for a schema registry which give only their subject, along with the
+// schema itself where the encoding doesn't give one. Protobuf schemas are given as .proto source, to be compiled along
+// with any other source. The registry may be nil, in which case encodings needing it are rejected.
+func FillSchemaRegistryEncodings(registry SchemaRegistry, path string, encodings ...*serialization.SerializationEncoding) error {
+	for _, encoding := range encodings {
+		framing, hasSchema := schemaRegistryFraming(encoding)
+		if framing == nil || (framing.SchemaId != 0 && hasSchema) {
+			continue
+		}
+		if registry == nil {
+			return fmt.Errorf("the %s encoding for %s needs a schema registry to resolve its schema, "+
+				"but neither --schema-registry-url nor --schema-directory was given", encoding.Type, path)
+		}
+
+		var schema *RegisteredSchema
+		var err error
+		switch {
+		case framing.SchemaId != 0:
+			schema, err = registry.SchemaById(framing.SchemaId)
+		case framing.Subject != "":
+			schema, err = registry.LatestSchema(framing.Subject)
+		default:
+			return fmt.Errorf("the %s encoding for %s gives neither a subject nor a schemaId in schemaRegistry",
+				encoding.Type, path)
+		}
+		if err != nil {
+			return fmt.Errorf("unable to resolve the schema for %s: %v", path, err)
+		}
+		framing.SchemaId = schema.Id
+		if hasSchema {
+			continue
+		}
+
+		err = fillSchema(registry, encoding, schema)
+		if err != nil {
+			return fmt.Errorf("unable to resolve the schema for %s: %v", path, err)
+		}
+		fmt.Printf("Using schema id %d for %s\n", schema.Id, path)
+	}
+	return nil
+}
+
+// Whether the encoding already gives its schema is returned too.
+func schemaRegistryFraming(encoding *serialization.SerializationEncoding) (*serialization.SchemaRegistryFraming, bool) {
+	if encoding == nil {
+		return nil, false
+	}
+	if description := encoding.GetProtobufDescription(); description != nil {
+		hasSchema := len(description.FileDescriptorSet) > 0 || description.FileDescriptorSetBase64 != "" ||
+			len(description.ProtoSource) > 0
+		return description.SchemaRegistry, hasSchema
+	}
+	if description, isAvro := encoding.Description.(*AvroEncodingDescription); isAvro {
+		return description.SchemaRegistry, len(description.WriterSchema) > 0
+	}
+	return nil, false
+}
+
+func fillSchema(registry SchemaRegistry, encoding *serialization.SerializationEncoding, schema *RegisteredSchema) error {
+	if description := encoding.GetProtobufDescription(); description != nil {
+		if schema.SchemaType != "PROTOBUF" {
+			return fmt.Errorf("schema id %d is a %s schema, not PROTOBUF", schema.Id, schemaTypeName(schema))
+		}
+		description.ProtoSource = map[string]string{}
+		return addProtoSource(registry, description.ProtoSource, fmt.Sprintf("schema_%d.proto", schema.Id), schema)
+	}
+
+	if schema.SchemaType != "" && schema.SchemaType != "AVRO" {
+		return fmt.Errorf("schema id %d is a %s schema, not AVRO", schema.Id, schemaTypeName(schema))
+	}
+	writerSchema, err := json.Marshal(schema.Schema)
+	if err != nil {
+		return err
+	}
+	encoding.Description.(*AvroEncodingDescription).WriterSchema = writerSchema
+	return nil
+}
+
+// Files imported by the schema are added under the name they're imported by.
+func addProtoSource(registry SchemaRegistry, source map[string]string, fileName string, schema *RegisteredSchema) error {
+	if _, added := source[fileName]; added {
+		return nil
+	}
+	source[fileName] = schema.Schema
+	for _, reference := range schema.References {
+		referenced, err := registry.SchemaVersion(reference.Subject, reference.Version)
+		if err != nil {
+			return err
+		}
+		err = addProtoSource(registry, source, reference.Name, referenced)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func schemaTypeName(schema *RegisteredSchema) string {
+	if schema.SchemaType == "" {
+		return "AVRO"
+	}
+	return schema.SchemaType
+}
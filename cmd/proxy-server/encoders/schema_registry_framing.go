@@ -0,0 +1,96 @@
+package encoders
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+const schemaRegistryMagicByte = 0
+
+// The schema id is resolved when the interaction is registered, so must be present by the time it's validated.
+func validateSchemaRegistryFraming(framing *serialization.SchemaRegistryFraming) error {
+	if framing != nil && framing.SchemaId == 0 {
+		return errors.New("schemaRegistry gives no schemaId, and none was resolved from its subject")
+	}
+	return nil
+}
+
+func writeSchemaRegistryFrame(framing *serialization.SchemaRegistryFraming, data []byte) []byte {
+	framed := make([]byte, 5, 5+len(data))
+	framed[0] = schemaRegistryMagicByte
+	binary.BigEndian.PutUint32(framed[1:], uint32(framing.SchemaId))
+	return append(framed, data...)
+}
+
+// Returns the schema id the body was framed with, and the body without its frame.
+func readSchemaRegistryFrame(data []byte) (int32, []byte, error) {
+	if len(data) < 5 {
+		return 0, nil, errors.New("body is too short for schema registry framing")
+	}
+	if data[0] != schemaRegistryMagicByte {
+		return 0, nil, fmt.Errorf("unknown schema registry magic byte %d, expected %d", data[0], schemaRegistryMagicByte)
+	}
+	return int32(binary.BigEndian.Uint32(data[1:5])), data[5:], nil
+}
+
+// The indexes of a protobuf message are its index among the messages of its file, followed by those among the nested
+// messages of each message it's nested in. They're written as a count followed by the indexes, all as zig-zag varints,
+// with the common case of the first message in the file written as a count of zero.
+func protobufMessageIndexes(msgDescriptor *desc.MessageDescriptor) []int64 {
+	indexes := make([]int64, 0)
+	var child desc.Descriptor = msgDescriptor
+	for {
+		var siblings []*desc.MessageDescriptor
+		switch parent := child.GetParent().(type) {
+		case *desc.MessageDescriptor:
+			siblings = parent.GetNestedMessageTypes()
+		case *desc.FileDescriptor:
+			siblings = parent.GetMessageTypes()
+		default:
+			return indexes
+		}
+		for i, sibling := range siblings {
+			if sibling == child {
+				indexes = append([]int64{int64(i)}, indexes...)
+			}
+		}
+		child = child.GetParent()
+	}
+}
+
+func writeProtobufMessageIndexes(indexes []int64) []byte {
+	if len(indexes) == 1 && indexes[0] == 0 {
+		return []byte{0}
+	}
+	data := make([]byte, binary.MaxVarintLen64*(1+len(indexes)))
+	size := binary.PutVarint(data, int64(len(indexes)))
+	for _, index := range indexes {
+		size += binary.PutVarint(data[size:], index)
+	}
+	return data[:size]
+}
+
+func readProtobufMessageIndexes(data []byte) ([]int64, []byte, error) {
+	count, read := binary.Varint(data)
+	if read <= 0 || count < 0 || count > int64(len(data)) {
+		return nil, nil, errors.New("invalid protobuf message indexes in schema registry framing")
+	}
+	data = data[read:]
+	if count == 0 {
+		return []int64{0}, data, nil
+	}
+	indexes := make([]int64, 0, count)
+	for i := int64(0); i < count; i++ {
+		index, read := binary.Varint(data)
+		if read <= 0 {
+			return nil, nil, errors.New("invalid protobuf message indexes in schema registry framing")
+		}
+		indexes = append(indexes, index)
+		data = data[read:]
+	}
+	return indexes, data, nil
+}
@@ -0,0 +1,187 @@
+package encoders
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+const framedProtoSource = `syntax = "proto3"; package events;
+	message Created { string name = 1; }
+	message Updated { message Name { string name = 1; } }`
+
+func getFramedProtobufEncoding(t *testing.T, messageName string) *serialization.SerializationEncoding {
+	encoding := &serialization.SerializationEncoding{
+		Type: "protobuf",
+		Description: &serialization.ProtobufEncodingDescription{
+			MessageName:    messageName,
+			ProtoSource:    map[string]string{"events.proto": framedProtoSource},
+			SchemaRegistry: &serialization.SchemaRegistryFraming{SchemaId: 7},
+		},
+	}
+	assert.Nil(t, descriptorlogic.CompileProtoSources(encoding))
+	assert.Nil(t, ValidateEncodings("users-topic", encoding))
+	return encoding
+}
+
+func TestAvroBodyFramedForSchemaRegistry(t *testing.T) {
+	encoding := getAvroEncoding(t, `{"writerSchema": `+userSchema+`, "schemaRegistry": {"schemaId": 7}}`)
+	assert.Nil(t, ValidateEncodings("users-topic", encoding))
+
+	binary, err := avroEncoder{}.JsonToBinary([]byte(`{"name": "Jo", "email": null}`), encoding, "users-topic")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 7, 4, 'J', 'o', 0}, binary)
+
+	jsonBytes, err := avroEncoder{}.BinaryToJson(binary, encoding, "users-topic")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name": "Jo", "email": null}`, string(jsonBytes))
+
+	_, err = avroEncoder{}.BinaryToJson([]byte{0, 0, 0, 0, 8, 4, 'J', 'o', 0}, encoding, "users-topic")
+	assert.EqualError(t, err, "body was written with schema id 8, but the pact's writerSchema is schema id 7")
+
+	_, err = avroEncoder{}.BinaryToJson([]byte{4, 'J', 'o', 0}, encoding, "users-topic")
+	assert.EqualError(t, err, "body is too short for schema registry framing")
+
+	_, err = avroEncoder{}.BinaryToJson([]byte{1, 0, 0, 0, 7, 4, 'J', 'o', 0}, encoding, "users-topic")
+	assert.EqualError(t, err, "unknown schema registry magic byte 1, expected 0")
+}
+
+func TestProtobufBodyFramedWithMessageIndexes(t *testing.T) {
+	// The first message in the file is written as a count of zero, and others as a count followed by the indexes
+	for messageName, frame := range map[string][]byte{
+		"events.Created":      {0, 0, 0, 0, 7, 0},
+		"events.Updated.Name": {0, 0, 0, 0, 7, 4, 2, 0},
+	} {
+		encoding := getFramedProtobufEncoding(t, messageName)
+
+		binary, err := protobufEncoder{}.JsonToBinary([]byte(`{"name": "Jo"}`), encoding, "users-topic")
+		assert.Nil(t, err, messageName)
+		assert.Equal(t, append(frame, 10, 2, 'J', 'o'), binary, messageName)
+
+		jsonBytes, err := protobufEncoder{}.BinaryToJson(binary, encoding, "users-topic")
+		assert.Nil(t, err, messageName)
+		assert.JSONEq(t, `{"name": "Jo"}`, string(jsonBytes), messageName)
+	}
+
+	// A newer schema id is read with the pact's schema, but the message must be the same
+	encoding := getFramedProtobufEncoding(t, "events.Created")
+	jsonBytes, err := protobufEncoder{}.BinaryToJson([]byte{0, 0, 0, 0, 9, 0, 10, 2, 'J', 'o'}, encoding, "users-topic")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name": "Jo"}`, string(jsonBytes))
+
+	_, err = protobufEncoder{}.BinaryToJson([]byte{0, 0, 0, 0, 7, 4, 2, 0, 10, 2, 'J', 'o'}, encoding, "users-topic")
+	assert.EqualError(t, err, "body has message indexes [1 0], but events.Created has message indexes [0]")
+}
+
+func TestSchemasResolvedFromSchemaRegistry(t *testing.T) {
+	requestedPaths := make([]string, 0)
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestedPaths = append(requestedPaths, r.URL.Path)
+		response, found := map[string]RegisteredSchema{
+			"/subjects/users-value/versions/latest": {Subject: "users-value", Version: 3, Id: 12, Schema: userSchema},
+			"/schemas/ids/13": {SchemaType: "PROTOBUF", References: []SchemaReference{
+				{Name: "common/name.proto", Subject: "name", Version: 1}},
+				Schema: `syntax = "proto3"; package events; import "common/name.proto"; message Created { common.Name name = 1; }`},
+			"/subjects/name/versions/1": {Subject: "name", Version: 1, Id: 2, SchemaType: "PROTOBUF",
+				Schema: `syntax = "proto3"; package common; message Name { string first = 1; }`},
+		}[r.URL.Path]
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error_code": 40401, "message": "Subject not found"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer registry.Close()
+
+	avroEncoding := getAvroEncoding(t, `{"schemaRegistry": {"subject": "users-value"}}`)
+	protobufEncoding := &serialization.SerializationEncoding{
+		Type: "protobuf",
+		Description: &serialization.ProtobufEncodingDescription{
+			MessageName:    "events.Created",
+			SchemaRegistry: &serialization.SchemaRegistryFraming{SchemaId: 13},
+		},
+	}
+	err := FillSchemaRegistryEncodings(NewSchemaRegistryClient(registry.URL), "users-topic", avroEncoding, protobufEncoding)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"/subjects/users-value/versions/latest", "/schemas/ids/13", "/subjects/name/versions/1"}, requestedPaths)
+	avroDescription := avroEncoding.Description.(*AvroEncodingDescription)
+	assert.Equal(t, int32(12), avroDescription.SchemaRegistry.SchemaId)
+	assert.Nil(t, (avroEncoder{}).Validate(avroEncoding, "users-topic"))
+	protoSource := protobufEncoding.GetProtobufDescription().ProtoSource
+	assert.Len(t, protoSource, 2)
+	assert.Contains(t, protoSource, "schema_13.proto")
+	assert.Contains(t, protoSource, "common/name.proto")
+	assert.Nil(t, descriptorlogic.CompileProtoSources(protobufEncoding))
+	assert.Nil(t, (protobufEncoder{}).Validate(protobufEncoding, "users-topic"))
+
+	missingEncoding := getAvroEncoding(t, `{"schemaRegistry": {"subject": "accounts-value"}}`)
+	err = FillSchemaRegistryEncodings(NewSchemaRegistryClient(registry.URL), "accounts-topic", missingEncoding)
+	assert.EqualError(t, err, "unable to resolve the schema for accounts-topic: schema registry returned 404 for "+
+		`/subjects/accounts-value/versions/latest: {"error_code": 40401, "message": "Subject not found"}`)
+}
+
+func TestSchemasResolvedFromSchemaDirectory(t *testing.T) {
+	directory, err := ioutil.TempDir("", "schemas")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(directory)
+	for fileName, schema := range map[string]RegisteredSchema{
+		"users-value-1.json": {Subject: "users-value", Version: 1, Id: 4, Schema: `"string"`},
+		"users-value-2.json": {Subject: "users-value", Version: 2, Id: 9, Schema: userSchema},
+		"events.json":        {Subject: "events-value", Version: 1, Id: 5, SchemaType: "PROTOBUF", Schema: framedProtoSource},
+	} {
+		data, _ := json.Marshal(schema)
+		err = ioutil.WriteFile(filepath.Join(directory, fileName), data, 0666)
+		if err != nil {
+			panic(err)
+		}
+	}
+	schemas, err := LoadSchemaDirectory(directory)
+	assert.Nil(t, err)
+
+	// The latest version of the subject is used
+	encoding := getAvroEncoding(t, `{"schemaRegistry": {"subject": "users-value"}}`)
+	assert.Nil(t, FillSchemaRegistryEncodings(schemas, "users-topic", encoding))
+	assert.Nil(t, ValidateEncodings("users-topic", encoding))
+	binary, err := avroEncoder{}.JsonToBinary([]byte(`{"name": "Jo", "email": null}`), encoding, "users-topic")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 0, 0, 0, 9, 4, 'J', 'o', 0}, binary)
+
+	// A schema given in the encoding is kept, with only the id resolved
+	encoding = getAvroEncoding(t, `{"writerSchema": "\"string\"", "schemaRegistry": {"subject": "users-value"}}`)
+	assert.Nil(t, FillSchemaRegistryEncodings(schemas, "users-topic", encoding))
+	assert.JSONEq(t, `"\"string\""`, string(encoding.Description.(*AvroEncodingDescription).WriterSchema))
+	assert.Equal(t, int32(9), encoding.Description.(*AvroEncodingDescription).SchemaRegistry.SchemaId)
+
+	encoding = getAvroEncoding(t, `{"schemaRegistry": {"schemaId": 5}}`)
+	err = FillSchemaRegistryEncodings(schemas, "events-topic", encoding)
+	assert.EqualError(t, err, "unable to resolve the schema for events-topic: schema id 5 is a PROTOBUF schema, not AVRO")
+
+	encoding = getAvroEncoding(t, `{"schemaRegistry": {"subject": "users-value"}}`)
+	err = FillSchemaRegistryEncodings(nil, "users-topic", encoding)
+	assert.EqualError(t, err, "the avro encoding for users-topic needs a schema registry to resolve its schema, "+
+		"but neither --schema-registry-url nor --schema-directory was given")
+}
+
+func TestUnresolvedSchemaRegistryFramingRejected(t *testing.T) {
+	encoding := getAvroEncoding(t, `{"writerSchema": `+userSchema+`, "schemaRegistry": {"subject": "users-value"}}`)
+	err := ValidateEncodings("users-topic", encoding)
+	assert.EqualError(t, err, "invalid avro encoding for users-topic: "+
+		"schemaRegistry gives no schemaId, and none was resolved from its subject")
+
+	encoding = getFramedProtobufEncoding(t, "events.Created")
+	encoding.GetProtobufDescription().MessageName = ""
+	err = ValidateEncodings("users-topic", encoding)
+	assert.EqualError(t, err, "invalid protobuf encoding for users-topic: schemaRegistry framing needs a messageName")
+}
@@ -0,0 +1,282 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MessagePack and CBOR bodies need no schema, but have values which JSON doesn't. These are written to JSON as objects
+// with a single "$"-prefixed key:
+//   - byte strings as {"$bytes": "<base64>"}
+//   - maps with keys other than strings as {"$map": [[key, value], ...]}
+//   - MessagePack extension types as {"$ext": {"type": 1, "data": "<base64>"}}
+//   - CBOR tags as {"$tag": {"number": 1, "value": ...}}
+const (
+	bytesMarker = "$bytes"
+	mapMarker   = "$map"
+	extMarker   = "$ext"
+	tagMarker   = "$tag"
+)
+
+const maxSchemalessDepth = 64
+
+// The values which MessagePack and CBOR bodies are decoded to, and encoded from. Integers are int64 or, where they're
+// too large for one, uint64; maps are []schemalessMapEntry, so that keys may be of any type.
+type schemalessMapEntry struct {
+	key   interface{}
+	value interface{}
+}
+
+type schemalessExt struct {
+	extType int8
+	data    []byte
+}
+
+type schemalessTag struct {
+	number  uint64
+	content interface{}
+}
+
+// Extension types and tags are reported as they're found, as the consumer and provider may disagree on their meaning
+// without the pact showing it.
+func schemalessToJson(value interface{}, format string) ([]byte, error) {
+	converted, err := schemalessToJsonValue(value, "$", format)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+func schemalessToJsonValue(value interface{}, path string, format string) (interface{}, error) {
+	switch v := value.(type) {
+	case nil, bool, int64, uint64, string:
+		return v, nil
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("%s: %v can't be written as JSON", path, v)
+		}
+		return v, nil
+	case []byte:
+		return map[string]interface{}{bytesMarker: base64.StdEncoding.EncodeToString(v)}, nil
+	case []interface{}:
+		elems := make([]interface{}, 0, len(v))
+		for i, elem := range v {
+			converted, err := schemalessToJsonValue(elem, fmt.Sprintf("%s[%d]", path, i), format)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, converted)
+		}
+		return elems, nil
+	case []schemalessMapEntry:
+		return schemalessMapToJsonValue(v, path, format)
+	case schemalessExt:
+		fmt.Printf("%s extension type %d at %s is written as %s\n", format, v.extType, path, extMarker)
+		return map[string]interface{}{extMarker: map[string]interface{}{
+			"type": v.extType,
+			"data": base64.StdEncoding.EncodeToString(v.data),
+		}}, nil
+	case schemalessTag:
+		fmt.Printf("%s tag %d at %s is written as %s\n", format, v.number, path, tagMarker)
+		content, err := schemalessToJsonValue(v.content, path, format)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{tagMarker: map[string]interface{}{"number": v.number, "value": content}}, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported value %v", path, value)
+}
+
+// Maps keyed by strings are written as JSON objects, unless the object could be mistaken for one of the markers.
+func schemalessMapToJsonValue(entries []schemalessMapEntry, path string, format string) (interface{}, error) {
+	object := make(map[string]interface{}, len(entries))
+	for _, entry := range entries {
+		if key, isString := entry.key.(string); isString {
+			object[key] = entry.value
+		}
+	}
+	if len(object) == len(entries) && !(len(entries) == 1 && strings.HasPrefix(entries[0].key.(string), "$")) {
+		for key, value := range object {
+			converted, err := schemalessToJsonValue(value, path+"."+key, format)
+			if err != nil {
+				return nil, err
+			}
+			object[key] = converted
+		}
+		return object, nil
+	}
+
+	pairs := make([]interface{}, 0, len(entries))
+	for i, entry := range entries {
+		key, err := schemalessToJsonValue(entry.key, fmt.Sprintf("%s{key %d}", path, i), format)
+		if err != nil {
+			return nil, err
+		}
+		value, err := schemalessToJsonValue(entry.value, fmt.Sprintf("%s{value %d}", path, i), format)
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, []interface{}{key, value})
+	}
+	return map[string]interface{}{mapMarker: pairs}, nil
+}
+
+func schemalessFromJson(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	return schemalessFromJsonValue(value, "$", 0)
+}
+
+// Numbers are integers where they can be, and otherwise doubles.
+func schemalessFromJsonValue(value interface{}, path string, depth int) (interface{}, error) {
+	if depth > maxSchemalessDepth {
+		return nil, errors.New("JSON nested too deeply")
+	}
+	switch v := value.(type) {
+	case json.Number:
+		if integer, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			return integer, nil
+		}
+		if integer, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return integer, nil
+		}
+		return v.Float64()
+	case []interface{}:
+		elems := make([]interface{}, 0, len(v))
+		for i, elem := range v {
+			converted, err := schemalessFromJsonValue(elem, fmt.Sprintf("%s[%d]", path, i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, converted)
+		}
+		return elems, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for key, markedValue := range v {
+				if strings.HasPrefix(key, "$") {
+					return schemalessFromMarker(key, markedValue, path, depth)
+				}
+			}
+		}
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entries := make([]schemalessMapEntry, 0, len(keys))
+		for _, key := range keys {
+			converted, err := schemalessFromJsonValue(v[key], path+"."+key, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, schemalessMapEntry{key: key, value: converted})
+		}
+		return entries, nil
+	}
+	return value, nil
+}
+
+func schemalessFromMarker(marker string, value interface{}, path string, depth int) (interface{}, error) {
+	invalid := func() error {
+		return fmt.Errorf("%s: invalid %s value %v", path, marker, value)
+	}
+	switch marker {
+	case bytesMarker:
+		encoded, isString := value.(string)
+		if !isString {
+			return nil, invalid()
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, invalid()
+		}
+		return data, nil
+	case mapMarker:
+		pairs, isArray := value.([]interface{})
+		if !isArray {
+			return nil, invalid()
+		}
+		entries := make([]schemalessMapEntry, 0, len(pairs))
+		for i, pair := range pairs {
+			keyAndValue, isArray := pair.([]interface{})
+			if !isArray || len(keyAndValue) != 2 {
+				return nil, invalid()
+			}
+			key, err := schemalessFromJsonValue(keyAndValue[0], fmt.Sprintf("%s{key %d}", path, i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entryValue, err := schemalessFromJsonValue(keyAndValue[1], fmt.Sprintf("%s{value %d}", path, i), depth+1)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, schemalessMapEntry{key: key, value: entryValue})
+		}
+		return entries, nil
+	case extMarker:
+		ext, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil, invalid()
+		}
+		extType, typeErr := strconv.ParseInt(fmt.Sprint(ext["type"]), 10, 8)
+		encoded, isString := ext["data"].(string)
+		data, dataErr := base64.StdEncoding.DecodeString(encoded)
+		if typeErr != nil || !isString || dataErr != nil {
+			return nil, invalid()
+		}
+		return schemalessExt{extType: int8(extType), data: data}, nil
+	case tagMarker:
+		tag, isObject := value.(map[string]interface{})
+		if !isObject {
+			return nil, invalid()
+		}
+		number, err := strconv.ParseUint(fmt.Sprint(tag["number"]), 10, 64)
+		if err != nil {
+			return nil, invalid()
+		}
+		content, err := schemalessFromJsonValue(tag["value"], path, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		return schemalessTag{number: number, content: content}, nil
+	}
+	return nil, fmt.Errorf("%s: unknown marker %s, expected one of %s, %s, %s or %s",
+		path, marker, bytesMarker, mapMarker, extMarker, tagMarker)
+}
+
+// Reads MessagePack and CBOR data. Lengths are checked against the bytes remaining, so that a corrupt length can't
+// allocate more than the body's size.
+type schemalessReader struct {
+	data []byte
+}
+
+func (r *schemalessReader) take(n uint64) ([]byte, bool) {
+	if n > uint64(len(r.data)) {
+		return nil, false
+	}
+	taken := r.data[:n]
+	r.data = r.data[n:]
+	return taken, true
+}
+
+func (r *schemalessReader) remaining() int {
+	return len(r.data)
+}
+
+// Every element of an array or map takes at least one byte.
+func (r *schemalessReader) hasElements(count uint64) bool {
+	return count <= uint64(len(r.data))
+}
@@ -0,0 +1,437 @@
+package encoders
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+func init() {
+	Register("thrift", thriftEncoder{}, func() interface{} { return &ThriftEncodingDescription{} })
+}
+
+// The struct is described either by Thrift IDL, or by a schema already parsed from it. Bodies are the struct alone,
+// without a message envelope.
+type ThriftEncodingDescription struct {
+	StructName string        `json:"structName"`
+	Protocol   string        `json:"protocol,omitempty"`
+	Idl        string        `json:"idl,omitempty"`
+	Schema     *ThriftSchema `json:"schema,omitempty"`
+}
+
+type thriftEncoder struct{}
+
+// Structs are written to JSON as objects keyed by field name: binary fields are base64, and enums are written by name.
+func (thriftEncoder) BinaryToJson(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	description, structType, err := compileThriftEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newThriftReader(description.Protocol, data)
+	if err != nil {
+		return nil, err
+	}
+	value, err := readThriftStruct(reader, structType, 0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.remaining() > 0 {
+		return nil, fmt.Errorf("unexpected trailing bytes after Thrift struct %s", structType.name)
+	}
+	return json.Marshal(value)
+}
+
+func (thriftEncoder) JsonToBinary(data []byte, encoding *serialization.SerializationEncoding, path string) ([]byte, error) {
+	description, structType, err := compileThriftEncoding(encoding)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := newThriftWriter(description.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	err = decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+	err = writeThriftValue(writer, &thriftType{kind: "struct", structType: structType}, value, structType.name)
+	if err != nil {
+		return nil, err
+	}
+	return writer.bytes(), nil
+}
+
+func (thriftEncoder) Validate(encoding *serialization.SerializationEncoding, path string) error {
+	description, _, err := compileThriftEncoding(encoding)
+	if err != nil {
+		return err
+	}
+	_, err = newThriftWriter(description.Protocol)
+	return err
+}
+
+func (thriftEncoder) ContentType(encoding *serialization.SerializationEncoding) string {
+	if description, described := encoding.Description.(*ThriftEncodingDescription); described &&
+		description.Protocol == "compact" {
+		return "application/vnd.apache.thrift.compact"
+	}
+	return "application/vnd.apache.thrift.binary"
+}
+
+func compileThriftEncoding(encoding *serialization.SerializationEncoding) (*ThriftEncodingDescription, *thriftStructType, error) {
+	description, described := encoding.Description.(*ThriftEncodingDescription)
+	if !described {
+		return nil, nil, errors.New("no description given")
+	}
+	schema := description.Schema
+	if description.Idl != "" {
+		if schema != nil {
+			return nil, nil, errors.New("give either idl or schema, not both")
+		}
+		var err error
+		schema, err = ParseThriftIdl(description.Idl)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to parse Thrift IDL: %v", err)
+		}
+	}
+	if schema == nil {
+		return nil, nil, errors.New("no idl or schema given")
+	}
+	structType, err := compileThriftStruct(schema, description.StructName)
+	return description, structType, err
+}
+
+var thriftTypeIds = map[string]byte{
+	"bool": thriftBool, "byte": thriftByte, "i16": thriftI16, "i32": thriftI32, "i64": thriftI64,
+	"double": thriftDouble, "string": thriftString, "binary": thriftString, "struct": thriftStruct,
+	"enum": thriftI32, "list": thriftList, "set": thriftSet, "map": thriftMap,
+}
+
+// Required fields missing from the struct are reported, as the provider's struct has most likely changed.
+func readThriftStruct(reader thriftProtocolReader, structType *thriftStructType, depth int) (map[string]interface{}, error) {
+	value := map[string]interface{}{}
+	reader.readStructBegin()
+	for {
+		fieldType, id, err := reader.readFieldBegin()
+		if err != nil {
+			return nil, err
+		}
+		if fieldType == thriftStop {
+			break
+		}
+		field := structType.fieldById(id)
+		if field == nil {
+			err = skipThriftValue(reader, fieldType, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if expected := thriftTypeIds[field.fieldType.kind]; fieldType != expected {
+			return nil, fmt.Errorf("%s.%s has Thrift type id %d, expected %d", structType.name, field.Name, fieldType, expected)
+		}
+		value[field.Name], err = readThriftValue(reader, field.fieldType, depth+1)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %v", structType.name, field.Name, err)
+		}
+	}
+	reader.readStructEnd()
+
+	for _, field := range structType.fields {
+		if _, present := value[field.Name]; field.Required && !present {
+			return nil, fmt.Errorf("required field %s.%s is missing", structType.name, field.Name)
+		}
+	}
+	return value, nil
+}
+
+func readThriftValue(reader thriftProtocolReader, valueType *thriftType, depth int) (interface{}, error) {
+	if depth > 64 {
+		return nil, errors.New("Thrift data nested too deeply")
+	}
+	switch valueType.kind {
+	case "bool":
+		return reader.readBool()
+	case "byte":
+		return reader.readByte()
+	case "i16":
+		return reader.readI16()
+	case "i32":
+		return reader.readI32()
+	case "i64":
+		return reader.readI64()
+	case "double":
+		return reader.readDouble()
+	case "string":
+		value, err := reader.readBinary()
+		return string(value), err
+	case "binary":
+		value, err := reader.readBinary()
+		return base64.StdEncoding.EncodeToString(value), err
+	case "enum":
+		value, err := reader.readI32()
+		if err != nil {
+			return nil, err
+		}
+		for name, enumValue := range valueType.enum.Values {
+			if enumValue == value {
+				return name, nil
+			}
+		}
+		return value, nil
+	case "struct":
+		return readThriftStruct(reader, valueType.structType, depth)
+	case "list", "set":
+		elemType, size, err := reader.readListBegin()
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 && elemType != thriftTypeIds[valueType.elem.kind] {
+			return nil, fmt.Errorf("%s elements have Thrift type id %d, expected %d",
+				valueType.kind, elemType, thriftTypeIds[valueType.elem.kind])
+		}
+		elems := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			elem, err := readThriftValue(reader, valueType.elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+		return elems, nil
+	case "map":
+		keyType, elemType, size, err := reader.readMapBegin()
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 && (keyType != thriftTypeIds[valueType.key.kind] || elemType != thriftTypeIds[valueType.elem.kind]) {
+			return nil, fmt.Errorf("map has Thrift type ids %d and %d, expected %d and %d", keyType, elemType,
+				thriftTypeIds[valueType.key.kind], thriftTypeIds[valueType.elem.kind])
+		}
+		entries := make(map[string]interface{}, size)
+		for i := 0; i < size; i++ {
+			key, err := readThriftValue(reader, valueType.key, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			keyText, err := thriftMapKeyText(key, valueType.key)
+			if err != nil {
+				return nil, err
+			}
+			entries[keyText], err = readThriftValue(reader, valueType.elem, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return entries, nil
+	}
+	return nil, fmt.Errorf("unsupported Thrift type %s", valueType.kind)
+}
+
+// JSON object keys are strings, so maps can only be written to JSON where their keys have a textual form.
+func thriftMapKeyText(key interface{}, keyType *thriftType) (string, error) {
+	switch keyType.kind {
+	case "struct", "list", "set", "map", "double":
+		return "", fmt.Errorf("maps with %s keys can't be written as JSON", keyType.kind)
+	}
+	return fmt.Sprint(key), nil
+}
+
+func writeThriftValue(writer thriftProtocolWriter, valueType *thriftType, value interface{}, name string) error {
+	typeError := func() error {
+		return fmt.Errorf("%s: expected a JSON value for Thrift type %s, found %v", name, valueType.kind, value)
+	}
+	switch valueType.kind {
+	case "bool":
+		boolValue, isBool := value.(bool)
+		if !isBool {
+			return typeError()
+		}
+		writer.writeBool(boolValue)
+	case "byte", "i16", "i32", "i64":
+		number, err := thriftInteger(value, valueType.kind)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		switch valueType.kind {
+		case "byte":
+			writer.writeByte(int8(number))
+		case "i16":
+			writer.writeI16(int16(number))
+		case "i32":
+			writer.writeI32(int32(number))
+		default:
+			writer.writeI64(number)
+		}
+	case "double":
+		number, isNumber := value.(json.Number)
+		if !isNumber {
+			return typeError()
+		}
+		double, err := number.Float64()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		writer.writeDouble(double)
+	case "string":
+		text, isString := value.(string)
+		if !isString {
+			return typeError()
+		}
+		writer.writeBinary([]byte(text))
+	case "binary":
+		text, isString := value.(string)
+		if !isString {
+			return typeError()
+		}
+		data, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return fmt.Errorf("%s: binary values are written as base64: %v", name, err)
+		}
+		writer.writeBinary(data)
+	case "enum":
+		if enumName, isString := value.(string); isString {
+			enumValue, found := valueType.enum.Values[enumName]
+			if !found {
+				return fmt.Errorf("%s: %q is not a value of %s", name, enumName, valueType.enum.Name)
+			}
+			writer.writeI32(enumValue)
+			return nil
+		}
+		number, err := thriftInteger(value, "i32")
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		writer.writeI32(int32(number))
+	case "struct":
+		fields, isObject := value.(map[string]interface{})
+		if !isObject {
+			return typeError()
+		}
+		return writeThriftStruct(writer, valueType.structType, fields, name)
+	case "list", "set":
+		elems, isArray := value.([]interface{})
+		if !isArray {
+			return typeError()
+		}
+		writer.writeListBegin(thriftTypeIds[valueType.elem.kind], len(elems))
+		for i, elem := range elems {
+			err := writeThriftValue(writer, valueType.elem, elem, fmt.Sprintf("%s[%d]", name, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "map":
+		entries, isObject := value.(map[string]interface{})
+		if !isObject {
+			return typeError()
+		}
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		writer.writeMapBegin(thriftTypeIds[valueType.key.kind], thriftTypeIds[valueType.elem.kind], len(entries))
+		for _, key := range keys {
+			keyValue, err := thriftMapKey(key, valueType.key)
+			if err == nil {
+				err = writeThriftValue(writer, valueType.key, keyValue, name)
+			}
+			if err == nil {
+				err = writeThriftValue(writer, valueType.elem, entries[key], fmt.Sprintf("%s[%q]", name, key))
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unsupported Thrift type %s", name, valueType.kind)
+	}
+	return nil
+}
+
+// Fields are written in the order they're declared, and fields the struct doesn't have are reported.
+func writeThriftStruct(writer thriftProtocolWriter, structType *thriftStructType, fields map[string]interface{}, name string) error {
+	for fieldName := range fields {
+		if structType.fieldByName(fieldName) == nil {
+			return fmt.Errorf("%s: %s has no field %q", name, structType.name, fieldName)
+		}
+	}
+	writer.writeStructBegin()
+	for _, field := range structType.fields {
+		value, present := fields[field.Name]
+		if !present || value == nil {
+			if field.Required {
+				return fmt.Errorf("%s: required field %s.%s is missing", name, structType.name, field.Name)
+			}
+			continue
+		}
+		writer.writeFieldBegin(thriftTypeIds[field.fieldType.kind], field.Id)
+		err := writeThriftValue(writer, field.fieldType, value, name+"."+field.Name)
+		if err != nil {
+			return err
+		}
+	}
+	writer.writeFieldStop()
+	writer.writeStructEnd()
+	return nil
+}
+
+// Converts a JSON object key back to the value of the map's key type.
+func thriftMapKey(key string, keyType *thriftType) (interface{}, error) {
+	switch keyType.kind {
+	case "bool":
+		return strconv.ParseBool(key)
+	case "byte", "i16", "i32", "i64":
+		return json.Number(key), nil
+	case "enum":
+		if _, err := strconv.ParseInt(key, 10, 32); err == nil {
+			return json.Number(key), nil
+		}
+		return key, nil
+	case "string", "binary":
+		return key, nil
+	}
+	return nil, fmt.Errorf("maps with %s keys can't be read from JSON", keyType.kind)
+}
+
+var thriftIntegerBits = map[string]uint{"byte": 8, "i16": 16, "i32": 32, "i64": 64}
+
+func thriftInteger(value interface{}, kind string) (int64, error) {
+	number, isNumber := value.(json.Number)
+	if !isNumber {
+		return 0, fmt.Errorf("expected a JSON number for Thrift type %s, found %v", kind, value)
+	}
+	integer, err := strconv.ParseInt(number.String(), 10, int(thriftIntegerBits[kind]))
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a valid %s", number, kind)
+	}
+	return integer, nil
+}
+
+func (structType *thriftStructType) fieldById(id int16) *thriftFieldType {
+	for _, field := range structType.fields {
+		if field.Id == id {
+			return field
+		}
+	}
+	return nil
+}
+
+func (structType *thriftStructType) fieldByName(name string) *thriftFieldType {
+	for _, field := range structType.fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
@@ -0,0 +1,555 @@
+package encoders
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The parts of a Thrift schema which are needed to convert structs: services and constants are left out. Types are
+// written as they are in Thrift IDL, e.g. "map<string, list<Address>>".
+type ThriftSchema struct {
+	Structs  []ThriftStruct  `json:"structs"`
+	Enums    []ThriftEnum    `json:"enums,omitempty"`
+	Typedefs []ThriftTypedef `json:"typedefs,omitempty"`
+}
+
+// Unions and exceptions are held as structs, as they're written in the same way.
+type ThriftStruct struct {
+	Name   string        `json:"name"`
+	Fields []ThriftField `json:"fields"`
+}
+
+type ThriftField struct {
+	Id       int16  `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required,omitempty"`
+}
+
+type ThriftEnum struct {
+	Name   string           `json:"name"`
+	Values map[string]int32 `json:"values"`
+}
+
+type ThriftTypedef struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type thriftToken struct {
+	text string
+	line int
+}
+
+type thriftParser struct {
+	tokens []thriftToken
+	pos    int
+}
+
+// Comments may be written as `//`, `#` or `/* */`.
+func tokenizeThrift(text string) ([]thriftToken, error) {
+	tokens := make([]thriftToken, 0)
+	line := 1
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == '#' || strings.HasPrefix(text[i:], "//"):
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(text[i:], "/*"):
+			end := strings.Index(text[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated comment", line)
+			}
+			line += strings.Count(text[i:i+2+end], "\n")
+			i += end + 4
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(text[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("line %d: unterminated string", line)
+			}
+			tokens = append(tokens, thriftToken{text: text[i : i+end+2], line: line})
+			line += strings.Count(text[i:i+end+2], "\n")
+			i += end + 2
+		case isThriftWordByte(c):
+			start := i
+			for i < len(text) && isThriftWordByte(text[i]) {
+				i++
+			}
+			tokens = append(tokens, thriftToken{text: text[start:i], line: line})
+		default:
+			tokens = append(tokens, thriftToken{text: string(c), line: line})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isThriftWordByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || c == '+' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+func (p *thriftParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos].text
+}
+
+func (p *thriftParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *thriftParser) errorf(format string, args ...interface{}) error {
+	line := 0
+	if len(p.tokens) > 0 {
+		line = p.tokens[len(p.tokens)-1].line
+	}
+	if p.pos < len(p.tokens) {
+		line = p.tokens[p.pos].line
+	}
+	return fmt.Errorf("line %d: %s", line, fmt.Sprintf(format, args...))
+}
+
+func (p *thriftParser) expect(token string) error {
+	if next := p.next(); next != token {
+		p.pos--
+		return p.errorf("expected %q, found %q", token, next)
+	}
+	return nil
+}
+
+func (p *thriftParser) identifier() (string, error) {
+	token := p.next()
+	if token == "" || !(token[0] == '_' || unicode.IsLetter(rune(token[0]))) {
+		p.pos--
+		return "", p.errorf("expected a name, found %q", token)
+	}
+	return token, nil
+}
+
+// Skips a bracketed value, such as a constant's value or the annotations after a type.
+func (p *thriftParser) skipBalanced() error {
+	depth := 0
+	for {
+		token := p.next()
+		switch token {
+		case "":
+			return p.errorf("unexpected end of IDL")
+		case "(", "[", "{":
+			depth++
+		case ")", "]", "}":
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+func (p *thriftParser) skipAnnotations() error {
+	if p.peek() == "(" {
+		return p.skipBalanced()
+	}
+	return nil
+}
+
+func (p *thriftParser) skipSeparator() {
+	if p.peek() == "," || p.peek() == ";" {
+		p.pos++
+	}
+}
+
+func ParseThriftIdl(idl string) (*ThriftSchema, error) {
+	tokens, err := tokenizeThrift(idl)
+	if err != nil {
+		return nil, err
+	}
+	p := &thriftParser{tokens: tokens}
+	schema := &ThriftSchema{Structs: make([]ThriftStruct, 0)}
+	for p.peek() != "" {
+		switch keyword := p.next(); keyword {
+		case "include", "cpp_include":
+			p.next()
+		case "namespace":
+			p.next()
+			p.next()
+		case "typedef":
+			typeName, err := p.typeName()
+			if err != nil {
+				return nil, err
+			}
+			name, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			schema.Typedefs = append(schema.Typedefs, ThriftTypedef{Name: name, Type: typeName})
+		case "const":
+			_, err := p.typeName()
+			if err == nil {
+				_, err = p.identifier()
+			}
+			if err == nil {
+				err = p.expect("=")
+			}
+			if err == nil && (p.peek() == "[" || p.peek() == "{") {
+				err = p.skipBalanced()
+			} else if err == nil {
+				p.next()
+			}
+			if err != nil {
+				return nil, err
+			}
+		case "enum":
+			enum, err := p.enum()
+			if err != nil {
+				return nil, err
+			}
+			schema.Enums = append(schema.Enums, *enum)
+		case "struct", "union", "exception":
+			thriftStruct, err := p.structFields()
+			if err != nil {
+				return nil, err
+			}
+			schema.Structs = append(schema.Structs, *thriftStruct)
+		case "service":
+			for p.peek() != "{" && p.peek() != "" {
+				p.next()
+			}
+			err = p.skipBalanced()
+			if err != nil {
+				return nil, err
+			}
+		default:
+			p.pos--
+			return nil, p.errorf("unexpected %q", keyword)
+		}
+		err = p.skipAnnotations()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSeparator()
+	}
+	return schema, nil
+}
+
+// Values without one are numbered on from the previous value, starting from zero.
+func (p *thriftParser) enum() (*ThriftEnum, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	enum := &ThriftEnum{Name: name, Values: map[string]int32{}}
+	err = p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	next := int64(0)
+	for p.peek() != "}" {
+		valueName, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == "=" {
+			p.next()
+			valueText := p.next()
+			next, err = strconv.ParseInt(valueText, 0, 32)
+			if err != nil {
+				p.pos--
+				return nil, p.errorf("invalid value %q for %s.%s", valueText, name, valueName)
+			}
+		}
+		enum.Values[valueName] = int32(next)
+		next++
+		err = p.skipAnnotations()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSeparator()
+	}
+	p.next()
+	return enum, nil
+}
+
+// Fields without an id are numbered from -1 downwards, as the Thrift compiler does.
+func (p *thriftParser) structFields() (*ThriftStruct, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == "xsd_all" {
+		p.next()
+	}
+	thriftStruct := &ThriftStruct{Name: name, Fields: make([]ThriftField, 0)}
+	err = p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	nextImplicitId := int16(-1)
+	for p.peek() != "}" {
+		field := ThriftField{}
+		if idText := p.peek(); idText != "" && (unicode.IsDigit(rune(idText[0])) || idText[0] == '-') {
+			p.next()
+			id, err := strconv.ParseInt(idText, 0, 16)
+			if err != nil {
+				p.pos--
+				return nil, p.errorf("invalid field id %q in %s", idText, name)
+			}
+			field.Id = int16(id)
+			err = p.expect(":")
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			field.Id = nextImplicitId
+			nextImplicitId--
+		}
+		switch p.peek() {
+		case "required":
+			field.Required = true
+			p.next()
+		case "optional":
+			p.next()
+		}
+		field.Type, err = p.typeName()
+		if err != nil {
+			return nil, err
+		}
+		field.Name, err = p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == "=" {
+			p.next()
+			if p.peek() == "[" || p.peek() == "{" {
+				err = p.skipBalanced()
+			} else {
+				p.next()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = p.skipAnnotations()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSeparator()
+		thriftStruct.Fields = append(thriftStruct.Fields, field)
+	}
+	p.next()
+	return thriftStruct, nil
+}
+
+// Returns the type in a normalised form, e.g. "map<string,list<i32>>".
+func (p *thriftParser) typeName() (string, error) {
+	name, err := p.identifier()
+	if err != nil {
+		return "", err
+	}
+	var containerTypes []string
+	switch name {
+	case "list", "set":
+		err = p.expect("<")
+		if err != nil {
+			return "", err
+		}
+		elemType, err := p.typeName()
+		if err != nil {
+			return "", err
+		}
+		containerTypes = []string{elemType}
+	case "map":
+		err = p.expect("<")
+		if err != nil {
+			return "", err
+		}
+		keyType, err := p.typeName()
+		if err == nil {
+			err = p.expect(",")
+		}
+		if err != nil {
+			return "", err
+		}
+		valueType, err := p.typeName()
+		if err != nil {
+			return "", err
+		}
+		containerTypes = []string{keyType, valueType}
+	default:
+		return name, p.skipAnnotations()
+	}
+	err = p.expect(">")
+	if err != nil {
+		return "", err
+	}
+	return name + "<" + strings.Join(containerTypes, ",") + ">", p.skipAnnotations()
+}
+
+// A compiled Thrift type, with typedefs resolved.
+type thriftType struct {
+	// One of the base types (e.g. "i32" or "binary"), "list", "set", "map", "struct" or "enum"
+	kind       string
+	elem       *thriftType
+	key        *thriftType
+	structType *thriftStructType
+	enum       *ThriftEnum
+}
+
+type thriftStructType struct {
+	name   string
+	fields []*thriftFieldType
+}
+
+type thriftFieldType struct {
+	ThriftField
+	fieldType *thriftType
+}
+
+var thriftBaseTypes = map[string]string{
+	"bool": "bool", "byte": "byte", "i8": "byte", "i16": "i16", "i32": "i32", "i64": "i64", "double": "double",
+	"string": "string", "slist": "string", "binary": "binary",
+}
+
+type thriftSchemaCompiler struct {
+	schema   *ThriftSchema
+	structs  map[string]*thriftStructType
+	enums    map[string]*ThriftEnum
+	typedefs map[string]string
+	// Typedefs currently being resolved, so that cycles are reported rather than followed forever
+	resolving map[string]bool
+}
+
+// Compiles the named struct, along with every type it refers to.
+func compileThriftStruct(schema *ThriftSchema, structName string) (*thriftStructType, error) {
+	compiler := &thriftSchemaCompiler{
+		schema:    schema,
+		structs:   map[string]*thriftStructType{},
+		enums:     map[string]*ThriftEnum{},
+		typedefs:  map[string]string{},
+		resolving: map[string]bool{},
+	}
+	for i := range schema.Structs {
+		compiler.structs[schema.Structs[i].Name] = &thriftStructType{name: schema.Structs[i].Name}
+	}
+	for i := range schema.Enums {
+		compiler.enums[schema.Enums[i].Name] = &schema.Enums[i]
+	}
+	for _, typedef := range schema.Typedefs {
+		compiler.typedefs[typedef.Name] = typedef.Type
+	}
+	for _, thriftStruct := range schema.Structs {
+		compiled := compiler.structs[thriftStruct.Name]
+		ids := map[int16]bool{}
+		for _, field := range thriftStruct.Fields {
+			if ids[field.Id] {
+				return nil, fmt.Errorf("field id %d is used more than once in %s", field.Id, thriftStruct.Name)
+			}
+			ids[field.Id] = true
+			fieldType, err := compiler.resolve(field.Type)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %v", thriftStruct.Name, field.Name, err)
+			}
+			compiled.fields = append(compiled.fields, &thriftFieldType{ThriftField: field, fieldType: fieldType})
+		}
+	}
+
+	compiled, found := compiler.structs[compiler.localName(structName)]
+	if structName == "" || !found {
+		return nil, fmt.Errorf("struct %q not found in the Thrift schema", structName)
+	}
+	return compiled, nil
+}
+
+// Types from included files are referred to as "file.Type", and are looked up by their name alone.
+func (compiler *thriftSchemaCompiler) localName(name string) string {
+	if _, found := compiler.structs[name]; found {
+		return name
+	}
+	return name[strings.LastIndex(name, ".")+1:]
+}
+
+func (compiler *thriftSchemaCompiler) resolve(typeName string) (*thriftType, error) {
+	tokens, err := tokenizeThrift(typeName)
+	if err != nil {
+		return nil, err
+	}
+	p := &thriftParser{tokens: tokens}
+	normalised, err := p.typeName()
+	if err == nil && p.peek() != "" {
+		err = p.errorf("unexpected %q", p.peek())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid type %q: %v", typeName, err)
+	}
+
+	open := strings.IndexByte(normalised, '<')
+	if open < 0 {
+		return compiler.resolveNamed(normalised)
+	}
+	containerTypes := splitThriftTypeArguments(normalised[open+1 : len(normalised)-1])
+	resolved := make([]*thriftType, 0, len(containerTypes))
+	for _, containerType := range containerTypes {
+		elem, err := compiler.resolve(containerType)
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, elem)
+	}
+	if normalised[:open] == "map" {
+		return &thriftType{kind: "map", key: resolved[0], elem: resolved[1]}, nil
+	}
+	return &thriftType{kind: normalised[:open], elem: resolved[0]}, nil
+}
+
+func (compiler *thriftSchemaCompiler) resolveNamed(name string) (*thriftType, error) {
+	if kind, isBaseType := thriftBaseTypes[name]; isBaseType {
+		return &thriftType{kind: kind}, nil
+	}
+	localName := compiler.localName(name)
+	if thriftStruct, found := compiler.structs[localName]; found {
+		return &thriftType{kind: "struct", structType: thriftStruct}, nil
+	}
+	if enum, found := compiler.enums[localName]; found {
+		return &thriftType{kind: "enum", enum: enum}, nil
+	}
+	if typedef, found := compiler.typedefs[localName]; found {
+		if compiler.resolving[localName] {
+			return nil, fmt.Errorf("typedef %s refers to itself", localName)
+		}
+		compiler.resolving[localName] = true
+		defer delete(compiler.resolving, localName)
+		return compiler.resolve(typedef)
+	}
+	return nil, fmt.Errorf("unknown type %q", name)
+}
+
+// Splits the arguments of a normalised container type, e.g. "string,map<i32,i32>".
+func splitThriftTypeArguments(arguments string) []string {
+	split := make([]string, 0, 2)
+	depth, start := 0, 0
+	for i, c := range arguments {
+		switch c {
+		case '<':
+			depth++
+		case '>':
+			depth--
+		case ',':
+			if depth == 0 {
+				split = append(split, arguments[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(split, arguments[start:])
+}
@@ -0,0 +1,629 @@
+package encoders
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Thrift's type ids, as written by the binary protocol. The compact protocol has ids of its own, which are mapped to
+// and from these.
+const (
+	thriftStop   byte = 0
+	thriftBool   byte = 2
+	thriftByte   byte = 3
+	thriftDouble byte = 4
+	thriftI16    byte = 6
+	thriftI32    byte = 8
+	thriftI64    byte = 10
+	thriftString byte = 11
+	thriftStruct byte = 12
+	thriftMap    byte = 13
+	thriftSet    byte = 14
+	thriftList   byte = 15
+)
+
+var errThriftTruncated = errors.New("unexpected end of Thrift data")
+
+type thriftProtocolWriter interface {
+	writeStructBegin()
+	writeStructEnd()
+	writeFieldBegin(fieldType byte, id int16)
+	writeFieldStop()
+	writeBool(value bool)
+	writeByte(value int8)
+	writeI16(value int16)
+	writeI32(value int32)
+	writeI64(value int64)
+	writeDouble(value float64)
+	writeBinary(value []byte)
+	// Used for sets as well as lists.
+	writeListBegin(elemType byte, size int)
+	writeMapBegin(keyType byte, valueType byte, size int)
+	bytes() []byte
+}
+
+type thriftProtocolReader interface {
+	readStructBegin()
+	readStructEnd()
+	// The field type is thriftStop after the last field of the struct.
+	readFieldBegin() (byte, int16, error)
+	readBool() (bool, error)
+	readByte() (int8, error)
+	readI16() (int16, error)
+	readI32() (int32, error)
+	readI64() (int64, error)
+	readDouble() (float64, error)
+	readBinary() ([]byte, error)
+	readListBegin() (byte, int, error)
+	readMapBegin() (byte, byte, int, error)
+	remaining() int
+}
+
+func newThriftWriter(protocol string) (thriftProtocolWriter, error) {
+	switch protocol {
+	case "", "binary":
+		return &thriftBinaryWriter{}, nil
+	case "compact":
+		return &thriftCompactWriter{}, nil
+	}
+	return nil, fmt.Errorf("unknown Thrift protocol %q, expected binary or compact", protocol)
+}
+
+func newThriftReader(protocol string, data []byte) (thriftProtocolReader, error) {
+	switch protocol {
+	case "", "binary":
+		return &thriftBinaryReader{thriftBytes: thriftBytes{data: data}}, nil
+	case "compact":
+		return &thriftCompactReader{thriftBytes: thriftBytes{data: data}}, nil
+	}
+	return nil, fmt.Errorf("unknown Thrift protocol %q, expected binary or compact", protocol)
+}
+
+// Skips over a value which isn't in the schema, e.g. a field added by a newer version of the struct.
+func skipThriftValue(reader thriftProtocolReader, valueType byte, depth int) error {
+	if depth > 64 {
+		return errors.New("Thrift data nested too deeply")
+	}
+	var err error
+	switch valueType {
+	case thriftBool:
+		_, err = reader.readBool()
+	case thriftByte:
+		_, err = reader.readByte()
+	case thriftI16:
+		_, err = reader.readI16()
+	case thriftI32:
+		_, err = reader.readI32()
+	case thriftI64:
+		_, err = reader.readI64()
+	case thriftDouble:
+		_, err = reader.readDouble()
+	case thriftString:
+		_, err = reader.readBinary()
+	case thriftStruct:
+		reader.readStructBegin()
+		for {
+			fieldType, _, err := reader.readFieldBegin()
+			if err != nil {
+				return err
+			}
+			if fieldType == thriftStop {
+				break
+			}
+			err = skipThriftValue(reader, fieldType, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		reader.readStructEnd()
+	case thriftList, thriftSet:
+		elemType, size, err := reader.readListBegin()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			err = skipThriftValue(reader, elemType, depth+1)
+			if err != nil {
+				return err
+			}
+		}
+	case thriftMap:
+		keyType, valueType, size, err := reader.readMapBegin()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < size; i++ {
+			err = skipThriftValue(reader, keyType, depth+1)
+			if err == nil {
+				err = skipThriftValue(reader, valueType, depth+1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unknown Thrift type id %d", valueType)
+	}
+	return err
+}
+
+type thriftBytes struct {
+	data []byte
+}
+
+func (b *thriftBytes) take(n int) ([]byte, error) {
+	if n < 0 || n > len(b.data) {
+		return nil, errThriftTruncated
+	}
+	taken := b.data[:n]
+	b.data = b.data[n:]
+	return taken, nil
+}
+
+func (b *thriftBytes) remaining() int {
+	return len(b.data)
+}
+
+// Each element takes at least a byte, so larger sizes can only come from corrupt data.
+func (b *thriftBytes) checkSize(size int) (int, error) {
+	if size < 0 || size > len(b.data) {
+		return 0, fmt.Errorf("invalid Thrift container size %d", size)
+	}
+	return size, nil
+}
+
+type thriftBinaryWriter struct {
+	data []byte
+}
+
+func (w *thriftBinaryWriter) writeStructBegin() {}
+func (w *thriftBinaryWriter) writeStructEnd()   {}
+
+func (w *thriftBinaryWriter) writeFieldBegin(fieldType byte, id int16) {
+	w.data = append(w.data, fieldType)
+	w.writeI16(id)
+}
+
+func (w *thriftBinaryWriter) writeFieldStop() {
+	w.data = append(w.data, thriftStop)
+}
+
+func (w *thriftBinaryWriter) writeBool(value bool) {
+	if value {
+		w.data = append(w.data, 1)
+	} else {
+		w.data = append(w.data, 0)
+	}
+}
+
+func (w *thriftBinaryWriter) writeByte(value int8) {
+	w.data = append(w.data, byte(value))
+}
+
+func (w *thriftBinaryWriter) writeI16(value int16) {
+	w.data = append(w.data, byte(uint16(value)>>8), byte(value))
+}
+
+func (w *thriftBinaryWriter) writeI32(value int32) {
+	w.data = append(w.data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.data[len(w.data)-4:], uint32(value))
+}
+
+func (w *thriftBinaryWriter) writeI64(value int64) {
+	w.data = append(w.data, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(w.data[len(w.data)-8:], uint64(value))
+}
+
+func (w *thriftBinaryWriter) writeDouble(value float64) {
+	w.writeI64(int64(math.Float64bits(value)))
+}
+
+func (w *thriftBinaryWriter) writeBinary(value []byte) {
+	w.writeI32(int32(len(value)))
+	w.data = append(w.data, value...)
+}
+
+func (w *thriftBinaryWriter) writeListBegin(elemType byte, size int) {
+	w.data = append(w.data, elemType)
+	w.writeI32(int32(size))
+}
+
+func (w *thriftBinaryWriter) writeMapBegin(keyType byte, valueType byte, size int) {
+	w.data = append(w.data, keyType, valueType)
+	w.writeI32(int32(size))
+}
+
+func (w *thriftBinaryWriter) bytes() []byte {
+	return w.data
+}
+
+type thriftBinaryReader struct {
+	thriftBytes
+}
+
+func (r *thriftBinaryReader) readStructBegin() {}
+func (r *thriftBinaryReader) readStructEnd()   {}
+
+func (r *thriftBinaryReader) readFieldBegin() (byte, int16, error) {
+	fieldType, err := r.take(1)
+	if err != nil || fieldType[0] == thriftStop {
+		return thriftStop, 0, err
+	}
+	id, err := r.readI16()
+	return fieldType[0], id, err
+}
+
+func (r *thriftBinaryReader) readBool() (bool, error) {
+	value, err := r.readByte()
+	return value != 0, err
+}
+
+func (r *thriftBinaryReader) readByte() (int8, error) {
+	value, err := r.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return int8(value[0]), nil
+}
+
+func (r *thriftBinaryReader) readI16() (int16, error) {
+	value, err := r.take(2)
+	if err != nil {
+		return 0, err
+	}
+	return int16(binary.BigEndian.Uint16(value)), nil
+}
+
+func (r *thriftBinaryReader) readI32() (int32, error) {
+	value, err := r.take(4)
+	if err != nil {
+		return 0, err
+	}
+	return int32(binary.BigEndian.Uint32(value)), nil
+}
+
+func (r *thriftBinaryReader) readI64() (int64, error) {
+	value, err := r.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(value)), nil
+}
+
+func (r *thriftBinaryReader) readDouble() (float64, error) {
+	value, err := r.readI64()
+	return math.Float64frombits(uint64(value)), err
+}
+
+func (r *thriftBinaryReader) readBinary() ([]byte, error) {
+	size, err := r.readI32()
+	if err != nil {
+		return nil, err
+	}
+	return r.take(int(size))
+}
+
+func (r *thriftBinaryReader) readListBegin() (byte, int, error) {
+	elemType, err := r.take(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	size, err := r.readI32()
+	if err != nil {
+		return 0, 0, err
+	}
+	checkedSize, err := r.checkSize(int(size))
+	return elemType[0], checkedSize, err
+}
+
+func (r *thriftBinaryReader) readMapBegin() (byte, byte, int, error) {
+	types, err := r.take(2)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	size, err := r.readI32()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	checkedSize, err := r.checkSize(int(size))
+	return types[0], types[1], checkedSize, err
+}
+
+// The compact protocol's own type ids. Booleans in fields are written as part of the field header, as one of the two
+// boolean types.
+const (
+	compactBooleanTrue  byte = 1
+	compactBooleanFalse byte = 2
+)
+
+var compactTypes = map[byte]byte{
+	thriftBool:   compactBooleanTrue,
+	thriftByte:   3,
+	thriftI16:    4,
+	thriftI32:    5,
+	thriftI64:    6,
+	thriftDouble: 7,
+	thriftString: 8,
+	thriftList:   9,
+	thriftSet:    10,
+	thriftMap:    11,
+	thriftStruct: 12,
+}
+
+func fromCompactType(compactType byte) (byte, error) {
+	if compactType == compactBooleanFalse {
+		return thriftBool, nil
+	}
+	for thriftType, mapped := range compactTypes {
+		if mapped == compactType {
+			return thriftType, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown Thrift compact type id %d", compactType)
+}
+
+type thriftCompactWriter struct {
+	data         []byte
+	lastFieldId  int16
+	lastFieldIds []int16
+	// The header of a boolean field is only written once its value is known.
+	boolFieldId *int16
+}
+
+func (w *thriftCompactWriter) writeStructBegin() {
+	w.lastFieldIds = append(w.lastFieldIds, w.lastFieldId)
+	w.lastFieldId = 0
+}
+
+func (w *thriftCompactWriter) writeStructEnd() {
+	w.lastFieldId = w.lastFieldIds[len(w.lastFieldIds)-1]
+	w.lastFieldIds = w.lastFieldIds[:len(w.lastFieldIds)-1]
+}
+
+func (w *thriftCompactWriter) writeFieldBegin(fieldType byte, id int16) {
+	if fieldType == thriftBool {
+		w.boolFieldId = &id
+		return
+	}
+	w.writeFieldHeader(compactTypes[fieldType], id)
+}
+
+func (w *thriftCompactWriter) writeFieldHeader(compactType byte, id int16) {
+	if id > w.lastFieldId && id-w.lastFieldId <= 15 {
+		w.data = append(w.data, byte(id-w.lastFieldId)<<4|compactType)
+	} else {
+		w.data = append(w.data, compactType)
+		w.writeI16(id)
+	}
+	w.lastFieldId = id
+}
+
+func (w *thriftCompactWriter) writeFieldStop() {
+	w.data = append(w.data, thriftStop)
+}
+
+func (w *thriftCompactWriter) writeBool(value bool) {
+	compactType := compactBooleanFalse
+	if value {
+		compactType = compactBooleanTrue
+	}
+	if w.boolFieldId != nil {
+		w.writeFieldHeader(compactType, *w.boolFieldId)
+		w.boolFieldId = nil
+		return
+	}
+	w.data = append(w.data, compactType)
+}
+
+func (w *thriftCompactWriter) writeByte(value int8) {
+	w.data = append(w.data, byte(value))
+}
+
+func (w *thriftCompactWriter) writeI16(value int16) {
+	w.writeI64(int64(value))
+}
+
+func (w *thriftCompactWriter) writeI32(value int32) {
+	w.writeI64(int64(value))
+}
+
+// Integers are written as zigzag varints.
+func (w *thriftCompactWriter) writeI64(value int64) {
+	w.writeVarint(uint64(value<<1) ^ uint64(value>>63))
+}
+
+func (w *thriftCompactWriter) writeVarint(value uint64) {
+	var buffer [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buffer[:], value)
+	w.data = append(w.data, buffer[:n]...)
+}
+
+func (w *thriftCompactWriter) writeDouble(value float64) {
+	w.data = append(w.data, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint64(w.data[len(w.data)-8:], math.Float64bits(value))
+}
+
+func (w *thriftCompactWriter) writeBinary(value []byte) {
+	w.writeVarint(uint64(len(value)))
+	w.data = append(w.data, value...)
+}
+
+func (w *thriftCompactWriter) writeListBegin(elemType byte, size int) {
+	if size < 15 {
+		w.data = append(w.data, byte(size)<<4|compactTypes[elemType])
+		return
+	}
+	w.data = append(w.data, 0xf0|compactTypes[elemType])
+	w.writeVarint(uint64(size))
+}
+
+func (w *thriftCompactWriter) writeMapBegin(keyType byte, valueType byte, size int) {
+	w.writeVarint(uint64(size))
+	if size > 0 {
+		w.data = append(w.data, compactTypes[keyType]<<4|compactTypes[valueType])
+	}
+}
+
+func (w *thriftCompactWriter) bytes() []byte {
+	return w.data
+}
+
+type thriftCompactReader struct {
+	thriftBytes
+	lastFieldId  int16
+	lastFieldIds []int16
+	boolField    *bool
+}
+
+func (r *thriftCompactReader) readStructBegin() {
+	r.lastFieldIds = append(r.lastFieldIds, r.lastFieldId)
+	r.lastFieldId = 0
+}
+
+func (r *thriftCompactReader) readStructEnd() {
+	r.lastFieldId = r.lastFieldIds[len(r.lastFieldIds)-1]
+	r.lastFieldIds = r.lastFieldIds[:len(r.lastFieldIds)-1]
+}
+
+func (r *thriftCompactReader) readFieldBegin() (byte, int16, error) {
+	header, err := r.take(1)
+	if err != nil || header[0] == thriftStop {
+		return thriftStop, 0, err
+	}
+	compactType := header[0] & 0x0f
+	id := r.lastFieldId + int16(header[0]>>4)
+	if header[0]>>4 == 0 {
+		id, err = r.readI16()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	r.lastFieldId = id
+
+	if compactType == compactBooleanTrue || compactType == compactBooleanFalse {
+		value := compactType == compactBooleanTrue
+		r.boolField = &value
+	}
+	fieldType, err := fromCompactType(compactType)
+	return fieldType, id, err
+}
+
+func (r *thriftCompactReader) readBool() (bool, error) {
+	if r.boolField != nil {
+		value := *r.boolField
+		r.boolField = nil
+		return value, nil
+	}
+	value, err := r.take(1)
+	if err != nil {
+		return false, err
+	}
+	return value[0] == compactBooleanTrue, nil
+}
+
+func (r *thriftCompactReader) readByte() (int8, error) {
+	value, err := r.take(1)
+	if err != nil {
+		return 0, err
+	}
+	return int8(value[0]), nil
+}
+
+func (r *thriftCompactReader) readI16() (int16, error) {
+	value, err := r.readI64()
+	if err != nil {
+		return 0, err
+	}
+	if value < math.MinInt16 || value > math.MaxInt16 {
+		return 0, errors.New("Thrift i16 out of range")
+	}
+	return int16(value), nil
+}
+
+func (r *thriftCompactReader) readI32() (int32, error) {
+	value, err := r.readI64()
+	if err != nil {
+		return 0, err
+	}
+	if value < math.MinInt32 || value > math.MaxInt32 {
+		return 0, errors.New("Thrift i32 out of range")
+	}
+	return int32(value), nil
+}
+
+func (r *thriftCompactReader) readI64() (int64, error) {
+	value, err := r.readVarint()
+	return int64(value>>1) ^ -int64(value&1), err
+}
+
+func (r *thriftCompactReader) readVarint() (uint64, error) {
+	value, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		return 0, errThriftTruncated
+	}
+	r.data = r.data[n:]
+	return value, nil
+}
+
+func (r *thriftCompactReader) readDouble() (float64, error) {
+	value, err := r.take(8)
+	if err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(value)), nil
+}
+
+func (r *thriftCompactReader) readBinary() ([]byte, error) {
+	size, err := r.readVarint()
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(len(r.data)) {
+		return nil, errThriftTruncated
+	}
+	return r.take(int(size))
+}
+
+func (r *thriftCompactReader) readListBegin() (byte, int, error) {
+	header, err := r.take(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	size := uint64(header[0] >> 4)
+	if size == 15 {
+		size, err = r.readVarint()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	elemType, err := fromCompactType(header[0] & 0x0f)
+	if err != nil {
+		return 0, 0, err
+	}
+	if size > uint64(len(r.data)) {
+		return 0, 0, fmt.Errorf("invalid Thrift container size %d", size)
+	}
+	return elemType, int(size), nil
+}
+
+func (r *thriftCompactReader) readMapBegin() (byte, byte, int, error) {
+	size, err := r.readVarint()
+	if err != nil || size == 0 {
+		return 0, 0, 0, err
+	}
+	if size > uint64(len(r.data)) {
+		return 0, 0, 0, fmt.Errorf("invalid Thrift container size %d", size)
+	}
+	types, err := r.take(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	keyType, err := fromCompactType(types[0] >> 4)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	valueType, err := fromCompactType(types[0] & 0x0f)
+	return keyType, valueType, int(size), err
+}
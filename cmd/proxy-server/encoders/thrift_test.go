@@ -0,0 +1,161 @@
+package encoders
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+	"github.com/stretchr/testify/assert"
+)
+
+const userIdl = `
+namespace go users // the namespace isn't needed
+include "shared.thrift"
+
+/* Users may be
+   inactive */
+enum Status { ACTIVE = 1, INACTIVE }
+
+typedef i32 UserId
+
+const list<string> ADMINS = ["root"]
+
+struct User {
+	1: required string name,
+	2: UserId id;
+	3: optional bool active = true (go.tag = "json:\"active\"")
+	4: list<Status> history
+	5: map<string, binary> avatars
+	16: i64 created
+}
+
+service Users extends shared.Base {
+	User get(1: UserId id) throws (1: NotFound notFound)
+}
+`
+
+func getThriftEncoding(t *testing.T, description string) *serialization.SerializationEncoding {
+	encoding := &serialization.SerializationEncoding{}
+	err := json.Unmarshal([]byte(`{"type": "thrift", "description": `+description+`}`), encoding)
+	if err != nil {
+		panic(err)
+	}
+	assert.Nil(t, ValidateEncodings("/users", encoding))
+	return encoding
+}
+
+func TestThriftIdlParsed(t *testing.T) {
+	schema, err := ParseThriftIdl(userIdl)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []ThriftEnum{{Name: "Status", Values: map[string]int32{"ACTIVE": 1, "INACTIVE": 2}}}, schema.Enums)
+	assert.Equal(t, []ThriftTypedef{{Name: "UserId", Type: "i32"}}, schema.Typedefs)
+	assert.Equal(t, []ThriftStruct{{Name: "User", Fields: []ThriftField{
+		{Id: 1, Name: "name", Type: "string", Required: true},
+		{Id: 2, Name: "id", Type: "UserId"},
+		{Id: 3, Name: "active", Type: "bool"},
+		{Id: 4, Name: "history", Type: "list<Status>"},
+		{Id: 5, Name: "avatars", Type: "map<string,binary>"},
+		{Id: 16, Name: "created", Type: "i64"},
+	}}}, schema.Structs)
+}
+
+func TestThriftStructWrittenInBinaryAndCompactProtocols(t *testing.T) {
+	idl, _ := json.Marshal(userIdl)
+	userJson := `{"name": "Jo", "id": 5, "active": true}`
+
+	binaryEncoding := getThriftEncoding(t, `{"structName": "User", "idl": `+string(idl)+`}`)
+	binary, err := thriftEncoder{}.JsonToBinary([]byte(userJson), binaryEncoding, "/users")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{
+		11, 0, 1, 0, 0, 0, 2, 'J', 'o',
+		8, 0, 2, 0, 0, 0, 5,
+		2, 0, 3, 1,
+		0}, binary)
+
+	// Fields are written with the difference from the previous field's id, and the boolean in the field's type
+	compactEncoding := getThriftEncoding(t, `{"structName": "User", "protocol": "compact", "idl": `+string(idl)+`}`)
+	compact, err := thriftEncoder{}.JsonToBinary([]byte(userJson), compactEncoding, "/users")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x18, 2, 'J', 'o', 0x15, 10, 0x11, 0}, compact)
+
+	for encoding, data := range map[*serialization.SerializationEncoding][]byte{binaryEncoding: binary, compactEncoding: compact} {
+		jsonBytes, err := thriftEncoder{}.BinaryToJson(data, encoding, "/users")
+		assert.Nil(t, err)
+		assert.JSONEq(t, userJson, string(jsonBytes))
+	}
+	assert.Equal(t, "application/vnd.apache.thrift.compact", thriftEncoder{}.ContentType(compactEncoding))
+}
+
+func TestThriftContainersRoundTrip(t *testing.T) {
+	userJson := `{"name": "Jo", "history": ["ACTIVE", "INACTIVE", "ACTIVE"], "avatars": {"small": "AAEC", "large": ""},
+		"created": 1600000000000}`
+	idl, _ := json.Marshal(userIdl)
+	for _, protocol := range []string{"binary", "compact"} {
+		encoding := getThriftEncoding(t, `{"structName": "User", "protocol": "`+protocol+`", "idl": `+string(idl)+`}`)
+
+		data, err := thriftEncoder{}.JsonToBinary([]byte(userJson), encoding, "/users")
+		assert.Nil(t, err, protocol)
+		jsonBytes, err := thriftEncoder{}.BinaryToJson(data, encoding, "/users")
+		assert.Nil(t, err, protocol)
+		assert.JSONEq(t, userJson, string(jsonBytes), protocol)
+	}
+}
+
+func TestThriftSchemaDescribesStruct(t *testing.T) {
+	encoding := getThriftEncoding(t, `{"structName": "Page", "schema": {
+		"structs": [
+			{"name": "Page", "fields": [{"id": 1, "name": "users", "type": "list<User>"}, {"id": 2, "name": "more", "type": "bool"}]},
+			{"name": "User", "fields": [{"id": 1, "name": "name", "type": "string"}]}]}}`)
+	pageJson := `{"users": [{"name": "Jo"}, {"name": "Sam"}], "more": false}`
+
+	data, err := thriftEncoder{}.JsonToBinary([]byte(pageJson), encoding, "/users")
+	assert.Nil(t, err)
+	jsonBytes, err := thriftEncoder{}.BinaryToJson(data, encoding, "/users")
+	assert.Nil(t, err)
+	assert.JSONEq(t, pageJson, string(jsonBytes))
+}
+
+func TestThriftStructChangesReported(t *testing.T) {
+	idl, _ := json.Marshal(userIdl)
+	encoding := getThriftEncoding(t, `{"structName": "User", "idl": `+string(idl)+`}`)
+
+	// Unknown fields are skipped, as a newer provider may have added them
+	jsonBytes, err := thriftEncoder{}.BinaryToJson([]byte{
+		11, 0, 1, 0, 0, 0, 2, 'J', 'o',
+		15, 0, 9, 8, 0, 0, 0, 1, 0, 0, 0, 7,
+		0}, encoding, "/users")
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name": "Jo"}`, string(jsonBytes))
+
+	_, err = thriftEncoder{}.BinaryToJson([]byte{8, 0, 2, 0, 0, 0, 5, 0}, encoding, "/users")
+	assert.EqualError(t, err, "required field User.name is missing")
+
+	_, err = thriftEncoder{}.BinaryToJson([]byte{11, 0, 1, 0, 0, 0, 2, 'J', 'o', 11, 0, 2, 0, 0, 0, 0, 0}, encoding, "/users")
+	assert.EqualError(t, err, "User.id has Thrift type id 11, expected 8")
+
+	_, err = thriftEncoder{}.JsonToBinary([]byte(`{"name": "Jo", "email": "jo@example.com"}`), encoding, "/users")
+	assert.EqualError(t, err, `User: User has no field "email"`)
+}
+
+func TestInvalidThriftDescriptionsReported(t *testing.T) {
+	for description, expected := range map[string]string{
+		`{"structName": "User"}`: "no idl or schema given",
+		`{"structName": "User", "idl": "struct User { 1: strng name }"}`:                             `User.name: unknown type "strng"`,
+		`{"structName": "Person", "idl": "struct User { 1: string name }"}`:                          `struct "Person" not found in the Thrift schema`,
+		`{"structName": "User", "idl": "struct User { 1: string name"}`:                              "unable to parse Thrift IDL: line 1: expected a name, found \"\"",
+		`{"structName": "User", "protocol": "json", "idl": "struct User { 1: string name }"}`:        `unknown Thrift protocol "json", expected binary or compact`,
+		`{"structName": "User", "idl": "struct User { 1: string name, 1: string email }"}`:           "field id 1 is used more than once in User",
+		`{"structName": "User", "idl": "typedef Id Id struct User { 1: Id id }"}`:                    "User.id: typedef Id refers to itself",
+		`{"structName": "User", "idl": "struct User {}", "schema": {"structs": [{"name": "User"}]}}`: "give either idl or schema, not both",
+	} {
+		encoding := &serialization.SerializationEncoding{}
+		err := json.Unmarshal([]byte(`{"type": "thrift", "description": `+description+`}`), encoding)
+		if err != nil {
+			panic(err)
+		}
+
+		err = ValidateEncodings("/users", encoding)
+		assert.EqualError(t, err, "invalid thrift encoding for /users: "+expected, description)
+	}
+}
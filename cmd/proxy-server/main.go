@@ -3,32 +3,51 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/descriptorlogic"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/encoders"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
 	"io/ioutil"
+	"net"
 	"os"
 
 	"github.com/gin-gonic/gin"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/controllers"
 	"github.com/mkideal/cli"
+	"google.golang.org/grpc"
 )
 
 func main() {
 	var ParsedArgs = new(domain.CliArgs)
 	cli.Run(ParsedArgs, func(ctx *cli.Context) error {
 		ParsedArgs = ctx.Argv().(*domain.CliArgs)
-		interactionLookup := domain.CreateEmptyInteractionLookup()
+		deps := controllers.RealDependencies(ParsedArgs)
+		if len(ParsedArgs.ProtoPaths) > 0 || len(ParsedArgs.BufImages) > 0 {
+			deps.LocalDescriptors = loadLocalDescriptors(ParsedArgs)
+		}
+		if ParsedArgs.SchemaRegistryUrl != "" || ParsedArgs.SchemaDirectory != "" {
+			deps.SchemaRegistry = loadSchemaRegistry(ParsedArgs)
+		}
 		if ParsedArgs.Verificaion {
-			interactionLookup = loadInteractionsFromPactFile(ParsedArgs)
+			pactContract := loadPactFile(ParsedArgs)
+			deps.InteractionLookup = domain.CreateInteractionLookupFromContract(pactContract)
+			deps.MessageLookup = domain.CreateMessageLookupFromContract(pactContract)
+			if ParsedArgs.GrpcReflection {
+				reportDescriptorDifferences(deps, pactContract)
+			}
+			if ParsedArgs.ProviderDescriptorSet != "" {
+				checkSchemaCompatibility(ParsedArgs, pactContract)
+			}
+		}
+		if ParsedArgs.GrpcPort != 0 && !ParsedArgs.Verificaion {
+			go serveGrpc(SetupGrpcServer(deps), fmt.Sprintf("%s:%d", ParsedArgs.Host, ParsedArgs.GrpcPort))
 		}
 
-		deps := controllers.RealDependencies(ParsedArgs)
-		deps.InteractionLookup = interactionLookup
 		return SetupRouter(deps).Run(fmt.Sprintf("%s:%d", ParsedArgs.Host, ParsedArgs.Port))
 	})
 }
 
-func loadInteractionsFromPactFile(args *domain.CliArgs) *domain.InteractionLookup {
+func loadPactFile(args *domain.CliArgs) *serialization.PactContract {
 	dat, err := ioutil.ReadFile(args.PactDir)
 	if err != nil {
 		fmt.Println(err)
@@ -42,11 +61,105 @@ func loadInteractionsFromPactFile(args *domain.CliArgs) *domain.InteractionLooku
 		os.Exit(1)
 	}
 
-	return domain.CreateInteractionLookupFromContract(&pactContract)
+	return &pactContract
+}
+
+func loadLocalDescriptors(args *domain.CliArgs) *descriptorlogic.LocalDescriptors {
+	localDescriptors, err := descriptorlogic.LoadLocalDescriptors(args.ProtoPaths, args.BufImages)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return localDescriptors
+}
+
+func loadSchemaRegistry(args *domain.CliArgs) encoders.SchemaRegistry {
+	if args.SchemaRegistryUrl != "" && args.SchemaDirectory != "" {
+		fmt.Println("Give either --schema-registry-url or --schema-directory, not both")
+		os.Exit(1)
+	}
+	if args.SchemaRegistryUrl != "" {
+		return encoders.NewSchemaRegistryClient(args.SchemaRegistryUrl)
+	}
+	schemaRegistry, err := encoders.LoadSchemaDirectory(args.SchemaDirectory)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return schemaRegistry
+}
+
+// Breaking changes to the provider's descriptors are reported up front, as they'd otherwise only show up as confusing
+// failures of whichever interactions use the changed messages.
+func reportDescriptorDifferences(deps *controllers.Dependencies, pactContract *serialization.PactContract) {
+	differences, err := deps.CompareProviderDescriptors(pactContract)
+	if err != nil {
+		fmt.Println("Unable to fetch the provider's descriptors over gRPC server reflection:", err)
+		os.Exit(1)
+	}
+	if len(differences) == 0 {
+		return
+	}
+	fmt.Println("Provider's descriptors differ from the contract:")
+	for _, difference := range differences {
+		fmt.Println("  ", difference)
+	}
+}
+
+// Verification can still pass when a field has been renumbered or retyped, as the provider's response may decode to
+// the expected JSON with the contract's descriptors, so such changes are checked for before verifying.
+func checkSchemaCompatibility(args *domain.CliArgs, pactContract *serialization.PactContract) {
+	contractSet, err := descriptorlogic.ContractFileDescriptorSet(pactContract)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	providerSet, err := descriptorlogic.ReadFileDescriptorSet(args.ProviderDescriptorSet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	incompatibilities, err := descriptorlogic.CheckSchemaCompatibility(contractSet, providerSet)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(incompatibilities) == 0 {
+		return
+	}
+	fmt.Println("Provider's schema has breaking changes from the contract:")
+	for _, incompatibility := range incompatibilities {
+		fmt.Println("  ", incompatibility)
+	}
+	if args.FailOnBreakingChanges {
+		os.Exit(1)
+	}
+}
+
+// gRPC consumers call the proxy directly, with each call being mapped onto an HTTP interaction for the Ruby core.
+func SetupGrpcServer(deps *controllers.Dependencies) *grpc.Server {
+	return grpc.NewServer(deps.GrpcServerOptions()...)
+}
+
+func serveGrpc(server *grpc.Server, address string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = server.Serve(listener)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 }
 
 func SetupRouter(deps *controllers.Dependencies) *gin.Engine {
 	r := gin.Default()
+	if deps.CliArgs.Messages {
+		return setupMessageRouter(deps, r)
+	}
 	r.DELETE("interactions", deps.HandleInteractionDelete)
 	r.GET("interactions/verification", deps.HandleGetVerification)
 	r.POST("interactions", deps.HandleInteractionAdd)
@@ -56,17 +169,27 @@ func SetupRouter(deps *controllers.Dependencies) *gin.Engine {
 	} else {
 		r.NoRoute(deps.HandleDynamicEndpoints)
 	}
-	// TODO: Need to support provider states - this will entail performing some matching on the request in order to work
-	// out which registered interaction a request made by the application under test pertains to (given the serialization
-	// for different interactions for a given endpoint may vary).
-	// TODO: Currently match statements are not supported: match statements mutate the body of the ServiceProviderRequest
-	// and at present the body is deserialized directly - this isn't an insurmountable problem if we demand that the
-	// serialization for a given endpoint is determined, for provider verification by (method * path * providerState).
-	// The Ruby core gets the providerState from the environment, maybe we should do the same.
-	// TODO: To handle match statements on the consumer-contract-creation-side, we don't know the request serialization,
-	// and so we should assume that's going to be the same for all requests. Response serialization can be determined
-	// by the status code returned by the Ruby core (as the core is actually capable of properly matching requests
-	// to their corresponding interactions).
+	// Note: several interactions may be registered against a single endpoint under different provider states. When
+	// verifying, the provider state is taken from a request header or the environment, otherwise the first
+	// interaction registered for the endpoint is used.
+	// Note: match statements are supported by converting only the example (generated) JSON bodies: the Ruby core
+	// applies the matching rules to the JSON, and on verification the proxy also checks the decoded protobuf against
+	// them so that mismatches can be reported by protobuf field.
+	// On the consumer-contract-creation-side, we don't know the request serialization, and so we assume that's going
+	// to be the same for all requests. Response serialization is determined by the status code returned by the Ruby
+	// core (as the core is actually capable of properly matching requests to their corresponding interactions).
+
+	return r
+}
 
+// Message pacts have no Ruby mock service behind them: on the consumer side messages are recorded by the proxy itself,
+// and on the provider side the verifier's requests are passed to the provider's message-producer endpoint.
+func setupMessageRouter(deps *controllers.Dependencies, r *gin.Engine) *gin.Engine {
+	if deps.CliArgs.Verificaion {
+		r.NoRoute(deps.HandleVerificationMessages)
+	} else {
+		r.POST("messages", deps.HandleMessageAdd)
+		r.POST("pact", deps.WriteMessagePactToFile)
+	}
 	return r
 }
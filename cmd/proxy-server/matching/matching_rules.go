@@ -0,0 +1,465 @@
+package matching
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
+)
+
+// Pact v2 matching rules apply to JSON paths rooted at "$.body", e.g. "$.body.users[*].name". Pact v3 rules for the
+// body are converted to this form.
+const bodyRoot = "$.body"
+
+type Mismatch struct {
+	JsonPath  string
+	ProtoPath string // Only populated if a message descriptor for the body is available
+	Message   string
+}
+
+func (m Mismatch) String() string {
+	if m.ProtoPath == "" {
+		return fmt.Sprintf("%s: %s", m.JsonPath, m.Message)
+	}
+	return fmt.Sprintf("%s (%s): %s", m.ProtoPath, m.JsonPath, m.Message)
+}
+
+type pathElement struct {
+	field   string
+	index   int
+	isIndex bool
+}
+
+type jsonPath []pathElement
+
+func (path jsonPath) String() string {
+	var builder strings.Builder
+	builder.WriteString(bodyRoot)
+	for _, element := range path {
+		if element.isIndex {
+			builder.WriteString("[" + strconv.Itoa(element.index) + "]")
+		} else {
+			builder.WriteString("." + element.field)
+		}
+	}
+	return builder.String()
+}
+
+func (path jsonPath) child(element pathElement) jsonPath {
+	childPath := make(jsonPath, len(path), len(path)+1)
+	copy(childPath, path)
+	return append(childPath, element)
+}
+
+type rule struct {
+	match string
+	regex *regexp.Regexp
+	min   int
+}
+
+type ruleKey struct {
+	elements []string
+	rule     rule
+}
+
+type checker struct {
+	rules      []ruleKey
+	descriptor *desc.MessageDescriptor
+	mismatches []Mismatch
+}
+
+// Checks the actual body of a response against the expected body from the contract, applying any matching rules
+// ("type", "regex" and "min") found for the body. If the body is a protobuf message then its descriptor should be
+// provided, in order that mismatches are reported by proto field path as well as JSON path.
+func CheckBody(expected []byte, actual []byte, matchingRules interface{}, descriptor *desc.MessageDescriptor) ([]Mismatch, error) {
+	var expectedBody, actualBody interface{}
+	if len(expected) == 0 {
+		return nil, nil
+	}
+	err := json.Unmarshal(expected, &expectedBody)
+	if err != nil {
+		return nil, err
+	}
+	if len(actual) > 0 {
+		err = json.Unmarshal(actual, &actualBody)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rules, err := parseBodyRules(matchingRules)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{rules: rules, descriptor: descriptor}
+	c.compare(expectedBody, actualBody, jsonPath{}, false)
+	return c.mismatches, nil
+}
+
+func parseBodyRules(matchingRules interface{}) ([]ruleKey, error) {
+	if serialization.IsV3MatchingRules(matchingRules) {
+		return parseV3BodyRules(serialization.GetV3MatchingRuleCategory(matchingRules, "body"))
+	}
+	rulesMap, isMap := matchingRules.(map[string]interface{})
+	if !isMap {
+		return nil, nil
+	}
+
+	rules := make([]ruleKey, 0, len(rulesMap))
+	for key, value := range rulesMap {
+		if key != bodyRoot && !strings.HasPrefix(key, bodyRoot+".") && !strings.HasPrefix(key, bodyRoot+"[") {
+			continue
+		}
+		definition, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("matching rule for %s is not an object", key)
+		}
+
+		parsedRule := rule{}
+		err := parsedRule.addMatcher(key, definition)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, ruleKey{elements: splitRulePath(strings.TrimPrefix(key, bodyRoot)), rule: parsedRule})
+	}
+	return sortBySpecificity(rules), nil
+}
+
+// Pact v3 body rules are keyed by JSON paths rooted at "$", and each has a list of matchers: these are combined into a
+// single rule, as only "AND" combination of matchers is supported.
+func parseV3BodyRules(bodyRules map[string]interface{}) ([]ruleKey, error) {
+	rules := make([]ruleKey, 0, len(bodyRules))
+	for key, value := range bodyRules {
+		definition, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, fmt.Errorf("matching rule for %s is not an object", key)
+		}
+		matchers, _ := definition["matchers"].([]interface{})
+
+		parsedRule := rule{}
+		for _, matcher := range matchers {
+			matcherDefinition, isMap := matcher.(map[string]interface{})
+			if !isMap {
+				return nil, fmt.Errorf("matcher for %s is not an object", key)
+			}
+			err := parsedRule.addMatcher(key, matcherDefinition)
+			if err != nil {
+				return nil, err
+			}
+		}
+		rules = append(rules, ruleKey{elements: splitRulePath(strings.TrimPrefix(key, "$")), rule: parsedRule})
+	}
+	return sortBySpecificity(rules), nil
+}
+
+func (r *rule) addMatcher(key string, definition map[string]interface{}) error {
+	if match, hasMatch := definition["match"].(string); hasMatch && (r.match == "" || match == "type") {
+		r.match = match
+	}
+	if min, hasMin := definition["min"].(float64); hasMin {
+		r.min = int(min)
+	}
+	if source, hasRegex := definition["regex"].(string); hasRegex {
+		regex, err := regexp.Compile(source)
+		if err != nil {
+			return fmt.Errorf("matching rule for %s has invalid regex: %v", key, err)
+		}
+		r.regex = regex
+	}
+	return nil
+}
+
+// Where several rules apply to a path, the one with the fewest wildcards wins
+func sortBySpecificity(rules []ruleKey) []ruleKey {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].wildcards() < rules[j].wildcards()
+	})
+	return rules
+}
+
+func (key ruleKey) wildcards() int {
+	count := 0
+	for _, element := range key.elements {
+		if element == "*" || element == "[*]" {
+			count++
+		}
+	}
+	return count
+}
+
+// Splits e.g. ".users[*].name" into ["users", "[*]", "name"]
+func splitRulePath(path string) []string {
+	elements := make([]string, 0)
+	for _, dotted := range strings.Split(path, ".") {
+		for len(dotted) > 0 {
+			bracket := strings.Index(dotted, "[")
+			if bracket < 0 {
+				elements = append(elements, dotted)
+				break
+			}
+			if bracket > 0 {
+				elements = append(elements, dotted[:bracket])
+			}
+			closing := strings.Index(dotted, "]")
+			if closing < bracket {
+				elements = append(elements, dotted[bracket:])
+				break
+			}
+			element := dotted[bracket : closing+1]
+			if strings.HasPrefix(element, "['") {
+				element = strings.TrimSuffix(strings.TrimPrefix(element, "['"), "']")
+			}
+			elements = append(elements, element)
+			dotted = dotted[closing+1:]
+		}
+	}
+	return elements
+}
+
+func (key ruleKey) matches(path jsonPath) bool {
+	if len(key.elements) != len(path) {
+		return false
+	}
+	for i, element := range path {
+		ruleElement := key.elements[i]
+		if element.isIndex {
+			if ruleElement != "[*]" && ruleElement != "["+strconv.Itoa(element.index)+"]" {
+				return false
+			}
+		} else if ruleElement != "*" && ruleElement != element.field {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *checker) ruleFor(path jsonPath) *rule {
+	for i := range c.rules {
+		if c.rules[i].matches(path) {
+			return &c.rules[i].rule
+		}
+	}
+	return nil
+}
+
+func (c *checker) addMismatch(path jsonPath, format string, args ...interface{}) {
+	c.mismatches = append(c.mismatches, Mismatch{
+		JsonPath:  path.String(),
+		ProtoPath: c.protoPath(path),
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+// Type matching cascades to the children of the node it's applied to, as in the Ruby core.
+func (c *checker) compare(expected interface{}, actual interface{}, path jsonPath, typeMatching bool) {
+	pathRule := c.ruleFor(path)
+	if pathRule != nil && pathRule.match == "type" {
+		typeMatching = true
+	}
+	if pathRule != nil && pathRule.regex != nil {
+		actualString, isString := actual.(string)
+		if !isString || !pathRule.regex.MatchString(actualString) {
+			c.addMismatch(path, "expected %v to match regex %s", actual, pathRule.regex.String())
+		}
+		return
+	}
+
+	switch expectedValue := expected.(type) {
+	case map[string]interface{}:
+		actualValue, isMap := actual.(map[string]interface{})
+		if !isMap {
+			c.addMismatch(path, "expected an object but got %v", actual)
+			return
+		}
+		keys := make([]string, 0, len(expectedValue))
+		for key := range expectedValue {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			expectedChild := expectedValue[key]
+			childPath := path.child(pathElement{field: key})
+			actualChild, present := actualValue[key]
+			if !present {
+				// Protobuf doesn't encode default values, so they're absent from the decoded JSON
+				if c.descriptor != nil && isProtobufDefault(expectedChild, c.protoField(childPath)) {
+					continue
+				}
+				c.addMismatch(childPath, "expected field to be present")
+				continue
+			}
+			c.compare(expectedChild, actualChild, childPath, typeMatching)
+		}
+	case []interface{}:
+		actualValue, isArray := actual.([]interface{})
+		if !isArray {
+			if actual == nil && len(expectedValue) == 0 && c.descriptor != nil {
+				return
+			}
+			c.addMismatch(path, "expected an array but got %v", actual)
+			return
+		}
+		if pathRule != nil && len(actualValue) < pathRule.min {
+			c.addMismatch(path, "expected at least %d elements but got %d", pathRule.min, len(actualValue))
+		}
+		if typeMatching {
+			if len(expectedValue) == 0 {
+				return
+			}
+			for i, actualChild := range actualValue {
+				c.compare(expectedValue[0], actualChild, path.child(pathElement{index: i, isIndex: true}), typeMatching)
+			}
+			return
+		}
+		if len(expectedValue) != len(actualValue) {
+			c.addMismatch(path, "expected %d elements but got %d", len(expectedValue), len(actualValue))
+			return
+		}
+		for i := range expectedValue {
+			c.compare(expectedValue[i], actualValue[i], path.child(pathElement{index: i, isIndex: true}), typeMatching)
+		}
+	default:
+		if field := c.protoField(path); field != nil && is64BitIntegerField(field) {
+			expectedInteger, expectedIsInteger := integerValue(expected)
+			actualInteger, actualIsInteger := integerValue(actual)
+			if expectedIsInteger && actualIsInteger {
+				if !typeMatching && expectedInteger != actualInteger {
+					c.addMismatch(path, "expected %s but got %s", expectedInteger, actualInteger)
+				}
+				return
+			}
+		}
+		if typeMatching {
+			if reflect.TypeOf(expected) != reflect.TypeOf(actual) {
+				c.addMismatch(path, "expected a value of the same type as %v but got %v", expected, actual)
+			}
+			return
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			c.addMismatch(path, "expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+// 64-bit integers are written to JSON as strings, so "0" is only a default for those fields.
+func isProtobufDefault(value interface{}, field *desc.FieldDescriptor) bool {
+	switch typedValue := value.(type) {
+	case nil:
+		return true
+	case string:
+		return typedValue == "" || (typedValue == "0" && field != nil && is64BitIntegerField(field))
+	case float64:
+		return typedValue == 0
+	case bool:
+		return !typedValue
+	case []interface{}:
+		return len(typedValue) == 0
+	case map[string]interface{}:
+		return len(typedValue) == 0
+	}
+	return false
+}
+
+func is64BitIntegerField(field *desc.FieldDescriptor) bool {
+	switch field.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_INT64, descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_SINT64, descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return true
+	}
+	return false
+}
+
+// The decimal form of a 64-bit integer given either as a number, as pacts usually give them, or as a string, as
+// decoded bodies give them, so that the two can be compared numerically.
+func integerValue(value interface{}) (string, bool) {
+	switch typedValue := value.(type) {
+	case float64:
+		if typedValue != math.Trunc(typedValue) {
+			return "", false
+		}
+		return strconv.FormatFloat(typedValue, 'f', -1, 64), true
+	case string:
+		if integer, err := strconv.ParseInt(typedValue, 10, 64); err == nil {
+			return strconv.FormatInt(integer, 10), true
+		}
+		if integer, err := strconv.ParseUint(typedValue, 10, 64); err == nil {
+			return strconv.FormatUint(integer, 10), true
+		}
+	}
+	return "", false
+}
+
+// Translates a JSON path into the corresponding path through the protobuf message, e.g. "$.body.users[0].name" into
+// "package.UserList.users[0].name".
+func (c *checker) protoPath(path jsonPath) string {
+	protoPath, _ := c.resolve(path)
+	return protoPath
+}
+
+// The field holding the value at the path (the field itself for elements of repeated fields, and the value field for
+// entries of maps), or nil if it isn't known.
+func (c *checker) protoField(path jsonPath) *desc.FieldDescriptor {
+	_, field := c.resolve(path)
+	return field
+}
+
+func (c *checker) resolve(path jsonPath) (string, *desc.FieldDescriptor) {
+	if c.descriptor == nil {
+		return "", nil
+	}
+
+	var builder strings.Builder
+	builder.WriteString(c.descriptor.GetFullyQualifiedName())
+	messageDescriptor := c.descriptor
+	var field, mapValue *desc.FieldDescriptor
+	for _, element := range path {
+		if element.isIndex {
+			builder.WriteString("[" + strconv.Itoa(element.index) + "]")
+			continue
+		}
+		if mapValue != nil {
+			builder.WriteString("[" + strconv.Quote(element.field) + "]")
+			field = mapValue
+			messageDescriptor = mapValue.GetMessageType()
+			mapValue = nil
+			continue
+		}
+		if messageDescriptor == nil {
+			builder.WriteString("." + element.field)
+			field = nil
+			continue
+		}
+		field = findFieldByJsonOrProtoName(messageDescriptor, element.field)
+		if field == nil {
+			builder.WriteString("." + element.field)
+			messageDescriptor = nil
+			continue
+		}
+		builder.WriteString("." + field.GetName())
+		if field.IsMap() {
+			mapValue = field.GetMapValueType()
+		} else {
+			messageDescriptor = field.GetMessageType()
+		}
+	}
+	return builder.String(), field
+}
+
+func findFieldByJsonOrProtoName(messageDescriptor *desc.MessageDescriptor, name string) *desc.FieldDescriptor {
+	for _, field := range messageDescriptor.GetFields() {
+		if field.GetJSONName() == name || field.GetName() == name {
+			return field
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package matching
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+)
+
+func getUserListDescriptor() *desc.MessageDescriptor {
+	file := &descriptor.FileDescriptorProto{
+		Name:    proto.String("users.proto"),
+		Package: proto.String("contract"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptor.DescriptorProto{
+			{
+				Name: proto.String("User"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("user_name"),
+						JsonName: proto.String("userName"),
+						Number:   proto.Int32(1),
+						Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_STRING.Enum(),
+					},
+					{
+						Name:     proto.String("id"),
+						JsonName: proto.String("id"),
+						Number:   proto.Int32(2),
+						Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_INT32.Enum(),
+					},
+					{
+						Name:     proto.String("created_at"),
+						JsonName: proto.String("createdAt"),
+						Number:   proto.Int32(3),
+						Label:    descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_INT64.Enum(),
+					},
+				},
+			},
+			{
+				Name: proto.String("UserList"),
+				Field: []*descriptor.FieldDescriptorProto{
+					{
+						Name:     proto.String("users"),
+						JsonName: proto.String("users"),
+						Number:   proto.Int32(1),
+						Label:    descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum(),
+						Type:     descriptor.FieldDescriptorProto_TYPE_MESSAGE.Enum(),
+						TypeName: proto.String(".contract.User"),
+					},
+				},
+			},
+		},
+	}
+	fileDescriptor, err := desc.CreateFileDescriptor(file)
+	if err != nil {
+		panic(err)
+	}
+	return fileDescriptor.FindMessage("contract.UserList")
+}
+
+func TestExactBodyMatches(t *testing.T) {
+	mismatches, err := CheckBody([]byte(`{"name":"Joe","id":1}`), []byte(`{"id":1,"name":"Joe","extra":true}`), nil, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches, "Unexpected keys are allowed in responses")
+
+	mismatches, err = CheckBody([]byte(`{"name":"Joe","id":1}`), []byte(`{"id":2,"name":"Joe"}`), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{{JsonPath: "$.body.id", Message: "expected 1 but got 2"}}, mismatches)
+}
+
+func TestTypeRegexAndMinRulesApplied(t *testing.T) {
+	rules := map[string]interface{}{
+		"$.body.users":             map[string]interface{}{"min": float64(2), "match": "type"},
+		"$.body.users[*].userName": map[string]interface{}{"match": "regex", "regex": "^[A-Z][a-z]+$"},
+	}
+	expected := []byte(`{"users":[{"userName":"Joe","id":1}]}`)
+
+	mismatches, err := CheckBody(expected, []byte(`{"users":[{"userName":"Ann","id":7},{"userName":"Bob","id":8}]}`), rules, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	mismatches, err = CheckBody(expected, []byte(`{"users":[{"userName":"ann","id":"7"}]}`), rules, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{
+		{JsonPath: "$.body.users", Message: "expected at least 2 elements but got 1"},
+		{JsonPath: "$.body.users[0].id", Message: "expected a value of the same type as 1 but got 7"},
+		{JsonPath: "$.body.users[0].userName", Message: "expected ann to match regex ^[A-Z][a-z]+$"},
+	}, mismatches)
+}
+
+func TestMismatchesReportedByProtoFieldPath(t *testing.T) {
+	rules := map[string]interface{}{
+		"$.body.users": map[string]interface{}{"min": float64(1), "match": "type"},
+	}
+	expected := []byte(`{"users":[{"userName":"Joe","id":1}]}`)
+
+	mismatches, err := CheckBody(expected, []byte(`{"users":[{"id":"7"}]}`), rules, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{
+		{JsonPath: "$.body.users[0].id", ProtoPath: "contract.UserList.users[0].id", Message: "expected a value of the same type as 1 but got 7"},
+		{JsonPath: "$.body.users[0].userName", ProtoPath: "contract.UserList.users[0].user_name", Message: "expected field to be present"},
+	}, mismatches)
+	assert.Equal(t, "contract.UserList.users[0].id ($.body.users[0].id): expected a value of the same type as 1 but got 7", mismatches[0].String())
+
+	// Default values aren't encoded by protobuf, so aren't expected to be present
+	mismatches, err = CheckBody([]byte(`{"users":[{"userName":"Joe","id":0}]}`), []byte(`{"users":[{"userName":"Joe"}]}`), nil, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestInt64FieldsComparedNumerically(t *testing.T) {
+	// jsonpb writes 64-bit integers as strings, which pacts usually give as numbers
+	mismatches, err := CheckBody([]byte(`{"users":[{"createdAt":1560000000000}]}`),
+		[]byte(`{"users":[{"createdAt":"1560000000000"}]}`), nil, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	mismatches, err = CheckBody([]byte(`{"users":[{"createdAt":1560000000000}]}`),
+		[]byte(`{"users":[{"createdAt":"1560000000001"}]}`), nil, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{{JsonPath: "$.body.users[0].createdAt", ProtoPath: "contract.UserList.users[0].created_at",
+		Message: "expected 1560000000000 but got 1560000000001"}}, mismatches)
+
+	rules := map[string]interface{}{"$.body.users": map[string]interface{}{"match": "type"}}
+	mismatches, err = CheckBody([]byte(`{"users":[{"createdAt":1}]}`), []byte(`{"users":[{"createdAt":"7"}]}`),
+		rules, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
+
+func TestOnlyInt64ZeroStringsTreatedAsDefaults(t *testing.T) {
+	mismatches, err := CheckBody([]byte(`{"users":[{"createdAt":"0","userName":"0"}]}`), []byte(`{"users":[{}]}`),
+		nil, getUserListDescriptor())
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{{JsonPath: "$.body.users[0].userName", ProtoPath: "contract.UserList.users[0].user_name",
+		Message: "expected field to be present"}}, mismatches)
+}
+
+func TestV3BodyRulesApplied(t *testing.T) {
+	rules := map[string]interface{}{
+		"body": map[string]interface{}{
+			"$.users": map[string]interface{}{
+				"matchers": []interface{}{map[string]interface{}{"match": "type", "min": float64(1)}},
+				"combine":  "AND",
+			},
+		},
+	}
+	expected := []byte(`{"users":[{"userName":"Joe","id":1}]}`)
+
+	mismatches, err := CheckBody(expected, []byte(`{"users":[{"userName":"Ann","id":7},{"userName":"Bob","id":"8"}]}`), rules, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []Mismatch{{JsonPath: "$.body.users[1].id", Message: "expected a value of the same type as 1 but got 8"}}, mismatches)
+}
+
+func TestRubyMatchersReifiedToExampleAndRules(t *testing.T) {
+	body := []byte(`{"users":{"json_class":"Pact::ArrayLike","contents":{"userName":{"json_class":"Pact::Term",` +
+		`"data":{"generate":"Joe","matcher":{"json_class":"Regexp","o":0,"s":"^[A-Z]"}}},"id":1},"min":2}}`)
+
+	example, rules, err := Reify(body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"users":[{"userName":"Joe","id":1},{"userName":"Joe","id":1}]}`, string(example))
+
+	// The rules produced can be applied directly when checking a body
+	mismatches, err := CheckBody(example, []byte(`{"users":[{"userName":"ann","id":1},{"userName":"Bob","id":2}]}`), rules, nil)
+	assert.NoError(t, err)
+	assert.Len(t, mismatches, 1)
+	assert.Equal(t, "$.body.users[0].userName", mismatches[0].JsonPath)
+}
@@ -0,0 +1,82 @@
+package matching
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+// The Ruby JSON form of the Pact matchers which consumer libraries send, e.g. {"json_class": "Pact::SomethingLike",
+// "contents": ...}
+const (
+	somethingLikeClass = "Pact::SomethingLike"
+	arrayLikeClass     = "Pact::ArrayLike"
+	termClass          = "Pact::Term"
+)
+
+// Replaces any Pact matchers in a body with their example values, as the Ruby core does, returning the example body
+// along with the equivalent Pact v3 matching rules for the body (or nil if there were no matchers).
+func Reify(body []byte) ([]byte, map[string]interface{}, error) {
+	var parsedBody interface{}
+	err := json.Unmarshal(body, &parsedBody)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules := map[string]interface{}{}
+	example := reifyValue(parsedBody, "$", rules)
+	exampleBytes, err := json.Marshal(example)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rules) == 0 {
+		return exampleBytes, nil, nil
+	}
+	return exampleBytes, map[string]interface{}{"body": rules}, nil
+}
+
+func addRule(rules map[string]interface{}, path string, matcher map[string]interface{}) {
+	rules[path] = map[string]interface{}{
+		"matchers": []interface{}{matcher},
+		"combine":  "AND",
+	}
+}
+
+func reifyValue(value interface{}, path string, rules map[string]interface{}) interface{} {
+	switch typedValue := value.(type) {
+	case map[string]interface{}:
+		switch typedValue["json_class"] {
+		case somethingLikeClass:
+			addRule(rules, path, map[string]interface{}{"match": "type"})
+			return reifyValue(typedValue["contents"], path, rules)
+		case arrayLikeClass:
+			min := 1
+			if minValue, hasMin := typedValue["min"].(float64); hasMin {
+				min = int(minValue)
+			}
+			addRule(rules, path, map[string]interface{}{"match": "type", "min": min})
+			element := reifyValue(typedValue["contents"], path+"[*]", rules)
+			examples := make([]interface{}, 0, min)
+			for i := 0; i < min; i++ {
+				examples = append(examples, element)
+			}
+			return examples
+		case termClass:
+			data, _ := typedValue["data"].(map[string]interface{})
+			matcher, _ := data["matcher"].(map[string]interface{})
+			addRule(rules, path, map[string]interface{}{"match": "regex", "regex": matcher["s"]})
+			return data["generate"]
+		}
+		reified := make(map[string]interface{}, len(typedValue))
+		for key, child := range typedValue {
+			reified[key] = reifyValue(child, path+"."+key, rules)
+		}
+		return reified
+	case []interface{}:
+		reified := make([]interface{}, 0, len(typedValue))
+		for i, child := range typedValue {
+			reified = append(reified, reifyValue(child, path+"["+strconv.Itoa(i)+"]", rules))
+		}
+		return reified
+	}
+	return value
+}
@@ -1,19 +1,56 @@
 package pactContractHandler
 
 import (
+	"fmt"
+
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/domain"
+	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/encoders"
 	"github.com/mcon/pact-serialization-proxy/cmd/proxy-server/serialization"
 )
 
 func PopulateContractFromInteractions(contract *serialization.PactContract, interactionLookup *domain.InteractionLookup) {
 	for i, _ := range contract.Interactions {
 		lookupKey := domain.CreateUniqueInteractionIdentifierFromInteraction(&contract.Interactions[i])
-		// TODO: A single path could have many different binary encodings (e.g. 400 could return different data structure to 200) - also, request/response different too
-		locallyRecordedInteraction, success := interactionLookup.Get(lookupKey)
+		locallyRecordedInteraction, success := findRecordedInteraction(interactionLookup, lookupKey, &contract.Interactions[i])
 		if success {
-			// TODO: If there's no encoding information, as it stands there'll be an empty Encoding field in the resulting contract
-			contract.Interactions[i].Response.Encoding = locallyRecordedInteraction.Response.Encoding
-			contract.Interactions[i].Request.Encoding = locallyRecordedInteraction.Request.Encoding
+			contract.Interactions[i].Response.Encoding = registeredEncoding(locallyRecordedInteraction.Response.Encoding)
+			contract.Interactions[i].Request.Encoding = registeredEncoding(locallyRecordedInteraction.Request.Encoding)
+		}
+	}
+}
+
+// Only encodings which the proxy has an encoder for are written to the contract, as the body couldn't be converted
+// when verifying otherwise.
+func registeredEncoding(encoding *serialization.SerializationEncoding) *serialization.SerializationEncoding {
+	if encoding == nil {
+		return nil
+	}
+	if _, registered := encoders.Lookup(encoding); !registered {
+		fmt.Printf("Not writing encoding of unknown type %q to the contract\n", encoding.Type)
+		return nil
+	}
+	return encoding
+}
+
+// The interaction description and provider state together identify an interaction within a contract - failing that
+// the response status is used, as a single endpoint can return different message types for different statuses (e.g.
+// an error message for a 400).
+func findRecordedInteraction(
+	interactionLookup *domain.InteractionLookup, lookupKey domain.UniqueInteractionIdentifier,
+	interaction *serialization.ProviderServiceInteraction) (serialization.ProviderServiceInteraction, bool) {
+	recordedInteractions, success := interactionLookup.Get(lookupKey)
+	if !success {
+		return serialization.ProviderServiceInteraction{}, false
+	}
+	for _, recordedInteraction := range recordedInteractions {
+		if recordedInteraction.Description == interaction.Description {
+			return recordedInteraction, true
+		}
+	}
+	for _, recordedInteraction := range recordedInteractions {
+		if recordedInteraction.Response.Status == interaction.Response.Status {
+			return recordedInteraction, true
 		}
 	}
+	return serialization.ProviderServiceInteraction{}, false
 }
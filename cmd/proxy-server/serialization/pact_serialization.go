@@ -1,19 +1,138 @@
 package serialization
 
-import "encoding/json"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
 
+// The descriptors can be given either as an array of byte values, or as a base64 string: the latter is far more compact,
+// and is the form in which pact files are written. Alternatively, the .proto source can be given (keyed by file name,
+// along with any files it imports), which is compiled into descriptors when the interaction is registered.
 type ProtobufEncodingDescription struct {
-	MessageName       string    `json:"messageName"`
-	FileDescriptorSet []float64 `json:"fileDescriptorSet"`
+	MessageName             string            `json:"messageName"`
+	FileDescriptorSet       []float64         `json:"fileDescriptorSet,omitempty"`
+	FileDescriptorSetBase64 string            `json:"fileDescriptorSetBase64,omitempty"`
+	ProtoSource             map[string]string `json:"protoSource,omitempty"`
+	// Set where bodies are framed for a schema registry, as Kafka messages often are
+	SchemaRegistry *SchemaRegistryFraming `json:"schemaRegistry,omitempty"`
 }
 
-// In general, the contents of `Description` might be different based on the `Type` of the encoding:
-// for now only protobuf is supported, so don't worry about that.
+// Bodies framed for a Confluent-compatible schema registry start with a zero magic byte and the big-endian 4-byte id of
+// their schema, followed (for protobuf) by the indexes of the message within its file. The schema id can be resolved
+// from the subject when the interaction is registered.
+type SchemaRegistryFraming struct {
+	Subject  string `json:"subject,omitempty"`
+	SchemaId int32  `json:"schemaId,omitempty"`
+}
+
+func (description *ProtobufEncodingDescription) GetFileDescriptorSetBytes() ([]byte, error) {
+	if description.FileDescriptorSetBase64 != "" {
+		return base64.StdEncoding.DecodeString(description.FileDescriptorSetBase64)
+	}
+	descriptorBytes := make([]byte, 0, len(description.FileDescriptorSet))
+	for _, child := range description.FileDescriptorSet {
+		descriptorBytes = append(descriptorBytes, byte(child))
+	}
+	return descriptorBytes, nil
+}
+
+// Returns a copy of the encoding with its descriptors in base64 form. Encodings are shared with the interaction lookup,
+// so they aren't changed in place.
+func (encoding *SerializationEncoding) compacted() *SerializationEncoding {
+	description := encoding.GetProtobufDescription()
+	if description == nil || len(description.FileDescriptorSet) == 0 {
+		return encoding
+	}
+	descriptorBytes, _ := description.GetFileDescriptorSetBytes()
+	return &SerializationEncoding{
+		Type: encoding.Type,
+		Description: &ProtobufEncodingDescription{
+			MessageName:             description.MessageName,
+			FileDescriptorSetBase64: base64.StdEncoding.EncodeToString(descriptorBytes),
+			SchemaRegistry:          description.SchemaRegistry,
+		},
+	}
+}
+
+// The contents of `Description` depend on the `Type` of the encoding: descriptions are decoded into the type registered
+// for the encoding (see RegisterEncodingDescription), and are kept as raw JSON for types without one.
 type SerializationEncoding struct {
 	Type        string
-	Description *ProtobufEncodingDescription
+	Description interface{}
+}
+
+var (
+	encodingDescriptions = map[string]func() interface{}{
+		"protobuf": func() interface{} { return &ProtobufEncodingDescription{} },
+	}
+	encodingDescriptionsLock sync.RWMutex
+)
+
+// Registers the type which descriptions of the given encoding type are decoded into, e.g. a pointer to a struct. The
+// returned function restores whatever was registered for the type before.
+func RegisterEncodingDescription(encodingType string, newDescription func() interface{}) (unregister func()) {
+	encodingDescriptionsLock.Lock()
+	defer encodingDescriptionsLock.Unlock()
+	previous, wasRegistered := encodingDescriptions[encodingType]
+	encodingDescriptions[encodingType] = newDescription
+	return func() {
+		encodingDescriptionsLock.Lock()
+		defer encodingDescriptionsLock.Unlock()
+		if wasRegistered {
+			encodingDescriptions[encodingType] = previous
+		} else {
+			delete(encodingDescriptions, encodingType)
+		}
+	}
+}
+
+func (encoding *SerializationEncoding) UnmarshalJSON(data []byte) error {
+	fields := struct {
+		Type        string
+		Description json.RawMessage
+	}{}
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	encoding.Type = fields.Type
+	encoding.Description = nil
+	if len(fields.Description) == 0 || string(fields.Description) == "null" {
+		return nil
+	}
+	encodingDescriptionsLock.RLock()
+	newDescription, registered := encodingDescriptions[fields.Type]
+	encodingDescriptionsLock.RUnlock()
+	if !registered {
+		encoding.Description = fields.Description
+		return nil
+	}
+	description := newDescription()
+	err = json.Unmarshal(fields.Description, description)
+	if err != nil {
+		return err
+	}
+	encoding.Description = description
+	return nil
 }
 
+// Returns nil unless this is a protobuf encoding with a description.
+func (encoding *SerializationEncoding) GetProtobufDescription() *ProtobufEncodingDescription {
+	if encoding == nil || encoding.Type != "protobuf" {
+		return nil
+	}
+	description, _ := encoding.Description.(*ProtobufEncodingDescription)
+	return description
+}
+
+// The body of a request or response. For streaming gRPC methods the body is a JSON array of the messages in the stream,
+// in order, which is how the Ruby core sees (and matches) them.
 type PactRequestBody struct {
 	data string
 }
@@ -25,6 +144,33 @@ func CreatePactRequestBody(data string) *PactRequestBody {
 	return &PactRequestBody{data: data}
 }
 
+func (body *PactRequestBody) GetString() string {
+	if body == nil {
+		return ""
+	}
+	return body.data
+}
+
+func CreateStreamedPactRequestBody(messages []json.RawMessage) (*PactRequestBody, error) {
+	data, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	return CreatePactRequestBody(string(data)), nil
+}
+
+func (body *PactRequestBody) GetStreamedMessages() ([]json.RawMessage, error) {
+	if body == nil {
+		return nil, nil
+	}
+	messages := make([]json.RawMessage, 0)
+	err := json.Unmarshal([]byte(body.data), &messages)
+	if err != nil {
+		return nil, fmt.Errorf("streamed body is not an array of messages: %v", err)
+	}
+	return messages, nil
+}
+
 func (body *PactRequestBody) MarshalJSON() ([]byte, error) {
 	return []byte(body.data), nil
 }
@@ -36,8 +182,8 @@ func (body *PactRequestBody) UnmarshalJSON(data []byte) error {
 
 type RegexMatcherDescription struct {
 	JsonClass string `json:"json_class"`
-	o         int32  // Pact-core specific fields not relevant to the serialization proxy
-	s         string
+	Options   int32  `json:"o"` // Ruby regex options, not relevant to the serialization proxy
+	Source    string `json:"s"`
 }
 
 type RexexMatcher struct {
@@ -52,19 +198,36 @@ type RegexedString struct {
 
 // TODO: The 'WithRegex' case can only apply in the body of posting to '/interactions', sadly matching rules in
 // the pact contract follow a different form
+// Pact v3 represents queries as a map of parameter name to values, rather than as a string: this is held in QueryMap.
 type PossiblyRegexedString struct {
 	NoRegex   string
 	WithRegex *RegexedString
+	QueryMap  map[string][]string
 }
 
 func (x *PossiblyRegexedString) GetString() string {
+	if x.QueryMap != nil {
+		return url.Values(x.QueryMap).Encode()
+	}
 	if x.WithRegex == nil {
 		return x.NoRegex
 	}
 	return x.WithRegex.Data.ExamplePath
 }
 
+// Returns nil if the string isn't a regex: note Pact terms use Ruby regex syntax, which is mostly (but not entirely)
+// compatible with Go's.
+func (x *PossiblyRegexedString) GetRegex() (*regexp.Regexp, error) {
+	if x.WithRegex == nil || x.WithRegex.Data == nil {
+		return nil, nil
+	}
+	return regexp.Compile(x.WithRegex.Data.Matcher.Source)
+}
+
 func (x *PossiblyRegexedString) MarshalJSON() ([]byte, error) {
+	if x.QueryMap != nil {
+		return json.Marshal(x.QueryMap)
+	}
 	if x.WithRegex != nil {
 		return json.Marshal(x.WithRegex)
 	}
@@ -72,7 +235,15 @@ func (x *PossiblyRegexedString) MarshalJSON() ([]byte, error) {
 }
 
 func (x *PossiblyRegexedString) UnmarshalJSON(data []byte) error {
-	err := json.Unmarshal(data, &x.WithRegex)
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err == nil {
+		if _, isTerm := fields["json_class"]; !isTerm {
+			return x.unmarshalQueryMap(fields)
+		}
+	}
+
+	err = json.Unmarshal(data, &x.WithRegex)
 
 	// Assume that if we don't have a regex, then there's just a raw string
 	if err != nil {
@@ -82,6 +253,31 @@ func (x *PossiblyRegexedString) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Pact v3 query values should be arrays, but single strings are accepted too.
+func (x *PossiblyRegexedString) unmarshalQueryMap(fields map[string]json.RawMessage) error {
+	x.QueryMap = make(map[string][]string, len(fields))
+	for name, rawValues := range fields {
+		var values []string
+		err := json.Unmarshal(rawValues, &values)
+		if err != nil {
+			var value string
+			err = json.Unmarshal(rawValues, &value)
+			if err != nil {
+				return fmt.Errorf("query parameter %s should be a string or array of strings: %v", name, err)
+			}
+			values = []string{value}
+		}
+		x.QueryMap[name] = values
+	}
+	return nil
+}
+
+// Pact v3 replaces the single providerState with a list of provider states, which may carry parameters.
+type ProviderState struct {
+	Name   string                 `json:"name"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
 type ProviderServiceRequest struct {
 	Method        string                 `json:"method"`
 	Path          *PossiblyRegexedString `json:"path"`
@@ -90,6 +286,7 @@ type ProviderServiceRequest struct {
 	Headers       interface{}            `json:"headers,omitempty"`
 	Body          *PactRequestBody       `json:"body,omitempty"`
 	MatchingRules interface{}            `json:"matchingRules,omitempty"` // Only applies to pact contract
+	Generators    interface{}            `json:"generators,omitempty"`    // Pact v3 only
 }
 
 type ProviderServiceResponse struct {
@@ -98,21 +295,71 @@ type ProviderServiceResponse struct {
 	Headers       interface{}            `json:"headers,omitempty"`
 	Body          *PactRequestBody       `json:"body,omitempty"`
 	MatchingRules interface{}            `json:"matchingRules,omitempty"` // Only applies to pact contract
+	Generators    interface{}            `json:"generators,omitempty"`    // Pact v3 only
 }
 
 type ProviderServiceInteraction struct {
-	Description   string                  `json:"description"`
-	ProviderState string                  `json:"providerState"`
-	Request       ProviderServiceRequest  `json:"request"`
-	Response      ProviderServiceResponse `json:"response"`
+	Description    string                  `json:"description"`
+	ProviderState  string                  `json:"providerState"`
+	ProviderStates []ProviderState         `json:"providerStates,omitempty"` // Pact v3 only
+	Request        ProviderServiceRequest  `json:"request"`
+	Response       ProviderServiceResponse `json:"response"`
+}
+
+// Where there are several Pact v3 provider states, these are combined in the order they're given.
+func (interaction *ProviderServiceInteraction) GetProviderState() string {
+	if interaction.ProviderState != "" || len(interaction.ProviderStates) == 0 {
+		return interaction.ProviderState
+	}
+	names := make([]string, 0, len(interaction.ProviderStates))
+	for _, state := range interaction.ProviderStates {
+		names = append(names, state.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// The contents of a message in a message pact, as opposed to the request or response of an HTTP interaction.
+type Message struct {
+	Contents      *PactRequestBody       `json:"contents,omitempty"`
+	Encoding      *SerializationEncoding `json:"encoding,omitempty"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	MatchingRules interface{}            `json:"matchingRules,omitempty"`
+	Generators    interface{}            `json:"generators,omitempty"`
+}
+
+// Asynchronous message interactions carry a single message: synchronous message interactions (Pact v4 only) have a
+// request message and any number of response messages.
+type MessageInteraction struct {
+	Type           string          `json:"type,omitempty"` // Pact v4 only
+	Description    string          `json:"description"`
+	ProviderState  string          `json:"providerState,omitempty"`
+	ProviderStates []ProviderState `json:"providerStates,omitempty"`
+	Message
+	Request  *Message  `json:"request,omitempty"`
+	Response []Message `json:"response,omitempty"`
+}
+
+func (interaction *MessageInteraction) GetProviderState() string {
+	return (&ProviderServiceInteraction{
+		ProviderState:  interaction.ProviderState,
+		ProviderStates: interaction.ProviderStates,
+	}).GetProviderState()
 }
 
 type PactSpecificationDescription struct {
 	Version string `json:"version"`
 }
 
+// Pact v4 plugins record their configuration against the contract, e.g. the protobuf plugin stores descriptors here.
+type PactPlugin struct {
+	Name          string                 `json:"name"`
+	Version       string                 `json:"version,omitempty"`
+	Configuration map[string]interface{} `json:"configuration,omitempty"`
+}
+
 type PactContractMetadata struct {
 	PactSpecification PactSpecificationDescription `json:"pactSpecification"`
+	Plugins           []PactPlugin                 `json:"plugins,omitempty"` // Pact v4 only
 }
 
 type ConsumerOrProvider struct {
@@ -123,5 +370,71 @@ type PactContract struct {
 	Consumer     ConsumerOrProvider           `json:"consumer"`
 	Provider     ConsumerOrProvider           `json:"provider"`
 	Interactions []ProviderServiceInteraction `json:"interactions"`
+	Messages     []MessageInteraction         `json:"messages,omitempty"`
 	Metadata     PactContractMetadata         `json:"metadata"`
 }
+
+// Writes the descriptors of every encoding in the contract in base64 form, rather than as arrays of byte values.
+func (contract *PactContract) CompactFileDescriptorSets() {
+	for i := range contract.Interactions {
+		contract.Interactions[i].Request.Encoding = contract.Interactions[i].Request.Encoding.compacted()
+		contract.Interactions[i].Response.Encoding = contract.Interactions[i].Response.Encoding.compacted()
+	}
+	for i := range contract.Messages {
+		message := &contract.Messages[i]
+		message.Encoding = message.Encoding.compacted()
+		if message.Request != nil {
+			request := *message.Request
+			request.Encoding = request.Encoding.compacted()
+			message.Request = &request
+		}
+		for j := range message.Response {
+			message.Response[j].Encoding = message.Response[j].Encoding.compacted()
+		}
+	}
+}
+
+// Used to (un)marshal the v2 and v3 form of the contract without recursing into PactContract's own (un)marshaling.
+type pactContractFields PactContract
+
+// v2 interactions always have a providerState, even if it's empty, but v3 has providerStates in its place.
+type v3ProviderServiceInteraction struct {
+	ProviderServiceInteraction
+	ProviderState string `json:"providerState,omitempty"`
+}
+
+func (contract PactContract) MarshalJSON() ([]byte, error) {
+	if contract.SpecificationMajorVersion() >= 4 {
+		return contract.marshalV4()
+	}
+	// The v2 and v3 specifications require the interactions, even in a pact holding only messages
+	fields := pactContractFields(contract)
+	if fields.Interactions == nil {
+		fields.Interactions = []ProviderServiceInteraction{}
+	}
+	if contract.SpecificationMajorVersion() < 3 {
+		return json.Marshal(fields)
+	}
+	interactions := make([]v3ProviderServiceInteraction, len(fields.Interactions))
+	for i, interaction := range fields.Interactions {
+		interactions[i] = v3ProviderServiceInteraction{interaction, interaction.ProviderState}
+	}
+	return json.Marshal(struct {
+		pactContractFields
+		Interactions []v3ProviderServiceInteraction `json:"interactions"`
+	}{fields, interactions})
+}
+
+func (contract *PactContract) UnmarshalJSON(data []byte) error {
+	versionProbe := PactContract{}
+	err := json.Unmarshal(data, &struct {
+		Metadata *PactContractMetadata `json:"metadata"`
+	}{Metadata: &versionProbe.Metadata})
+	if err != nil {
+		return err
+	}
+	if versionProbe.SpecificationMajorVersion() >= 4 {
+		return contract.unmarshalV4(data)
+	}
+	return json.Unmarshal(data, (*pactContractFields)(contract))
+}
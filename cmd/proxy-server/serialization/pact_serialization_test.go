@@ -96,3 +96,356 @@ func TestSerializationRoundTrips(t *testing.T) {
 
 	assert.Equal(t, expectedDataStructure, unmarshalledInteraction, "Expected DTO to round-trip")
 }
+
+func TestRegexedPathUnmarshalsFromPactTerm(t *testing.T) {
+	termJson := `{"json_class":"Pact::Term","data":{"generate":"/users/1","matcher":{"json_class":"Regexp","o":0,"s":"^/users/\\d+$"}}}`
+
+	path := new(PossiblyRegexedString)
+	err := json.Unmarshal([]byte(termJson), path)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	assert.Equal(t, "/users/1", path.GetString())
+
+	regex, err := path.GetRegex()
+	assert.NoError(t, err, "Term regex should compile")
+	assert.True(t, regex.MatchString("/users/42"))
+	assert.False(t, regex.MatchString("/users/abc"))
+
+	marshaled, err := json.Marshal(path)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.JSONEq(t, termJson, string(marshaled), "Expected term to round-trip")
+}
+
+func TestStreamedBodyHoldsMessagesInOrder(t *testing.T) {
+	body, err := CreateStreamedPactRequestBody([]json.RawMessage{[]byte(`{"name":"Joe"}`), []byte(`{"name":"Jane"}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"name":"Joe"},{"name":"Jane"}]`, body.GetString())
+
+	messages, err := body.GetStreamedMessages()
+	assert.Nil(t, err)
+	assert.Equal(t, []json.RawMessage{[]byte(`{"name":"Joe"}`), []byte(`{"name":"Jane"}`)}, messages)
+
+	_, err = CreatePactRequestBody(`{"name":"Joe"}`).GetStreamedMessages()
+	assert.NotNil(t, err)
+}
+
+func TestV3ContractRoundTrips(t *testing.T) {
+	contractJson := `{
+    "consumer": {"name": "Consumer"},
+    "provider": {"name": "Provider"},
+    "interactions": [{
+        "description": "Get a user",
+        "providerStates": [{"name": "User exists", "params": {"id": 42}}],
+        "request": {
+            "method": "GET",
+            "path": "/users/42",
+            "query": {"type": ["verified"], "sort": ["name", "id"]},
+            "matchingRules": {"path": {"matchers": [{"match": "regex", "regex": "^/users/\\d+$"}], "combine": "AND"}},
+            "generators": {"path": {"type": "ProviderState", "expression": "/users/${id}"}}
+        },
+        "response": {
+            "status": 200,
+            "encoding": {"Type": "protobuf", "Description": {"messageName": "User", "fileDescriptorSet": [1, 2, 3]}},
+            "body": {"name": "Joe"},
+            "matchingRules": {"body": {"$.name": {"matchers": [{"match": "type"}], "combine": "AND"}}}
+        }
+    }],
+    "metadata": {"pactSpecification": {"version": "3.0.0"}}
+}`
+	contract := PactContract{}
+	err := json.Unmarshal([]byte(contractJson), &contract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+
+	interaction := contract.Interactions[0]
+	assert.Equal(t, 3, contract.SpecificationMajorVersion())
+	assert.Equal(t, "User exists", interaction.GetProviderState())
+	assert.Equal(t, map[string]interface{}{"id": float64(42)}, interaction.ProviderStates[0].Params)
+	assert.Equal(t, "sort=name&sort=id&type=verified", interaction.Request.Query.GetString())
+	assert.Equal(t, "^/users/\\d+$", GetPathRegexFromMatchingRules(interaction.Request.MatchingRules))
+	assert.True(t, IsV3MatchingRules(interaction.Response.MatchingRules))
+	assert.Equal(t, "User", interaction.Response.Encoding.GetProtobufDescription().MessageName)
+
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.JSONEq(t, contractJson, string(marshaled), "Expected v3 contract to round-trip")
+}
+
+func TestMessagePactWrittenWithInteractions(t *testing.T) {
+	contract := PactContract{
+		Messages: []MessageInteraction{{Description: "A user has been created"}},
+		Metadata: PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV3}},
+	}
+
+	written, err := json.Marshal(contract)
+	assert.Nil(t, err)
+	fields := map[string]json.RawMessage{}
+	assert.Nil(t, json.Unmarshal(written, &fields))
+	assert.JSONEq(t, `[]`, string(fields["interactions"]))
+	assert.Contains(t, fields, "messages")
+
+	written, err = json.Marshal(PactContract{Interactions: []ProviderServiceInteraction{}})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(written), "messages")
+}
+
+func TestProviderStateAlwaysWrittenToV2Interactions(t *testing.T) {
+	contract := PactContract{
+		Interactions: []ProviderServiceInteraction{{Description: "Get a user"}},
+		Metadata:     PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV2}},
+	}
+
+	written, err := json.Marshal(contract)
+	assert.Nil(t, err)
+	assert.Contains(t, string(written), `"providerState":""`)
+
+	contract.Metadata.PactSpecification.Version = PactSpecificationV3
+	contract.Interactions[0].ProviderStates = []ProviderState{{Name: "User exists"}}
+	written, err = json.Marshal(contract)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(written), `"providerState"`)
+	assert.Contains(t, string(written), `"providerStates":[{"name":"User exists"}]`)
+}
+
+func TestContractUpgradedToV3WhenV3FeaturesUsed(t *testing.T) {
+	contract := PactContract{
+		Interactions: []ProviderServiceInteraction{
+			{
+				Description:   "Get a user",
+				ProviderState: "User exists",
+				Request: ProviderServiceRequest{
+					Method: "GET",
+					Path:   &PossiblyRegexedString{NoRegex: "/users"},
+					Query:  &PossiblyRegexedString{NoRegex: "type=verified"},
+				},
+				Response: ProviderServiceResponse{
+					Status:     200,
+					Generators: map[string]interface{}{"body": map[string]interface{}{}},
+				},
+			},
+		},
+		Metadata: PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: "2.0.0"}},
+	}
+
+	contract.NormaliseForSpecificationVersion()
+
+	assert.Equal(t, PactSpecificationV3, contract.Metadata.PactSpecification.Version)
+	assert.Equal(t, "", contract.Interactions[0].ProviderState)
+	assert.Equal(t, []ProviderState{{Name: "User exists"}}, contract.Interactions[0].ProviderStates)
+	assert.Equal(t, map[string][]string{"type": {"verified"}}, contract.Interactions[0].Request.Query.QueryMap)
+}
+
+func TestV4ContractRoundTripsWithEncodingsInBodyMetadata(t *testing.T) {
+	contract := PactContract{
+		Consumer: ConsumerOrProvider{Name: "Consumer"},
+		Provider: ConsumerOrProvider{Name: "Provider"},
+		Interactions: []ProviderServiceInteraction{
+			{
+				Description:    "Create a user",
+				ProviderStates: []ProviderState{{Name: "No users"}},
+				Request: ProviderServiceRequest{
+					Method:   "POST",
+					Path:     &PossiblyRegexedString{NoRegex: "/users"},
+					Query:    &PossiblyRegexedString{QueryMap: map[string][]string{"type": {"verified"}}},
+					Encoding: expectedDataStructure.Request.Encoding,
+					Headers:  map[string]interface{}{"Content-Type": []interface{}{"application/octet-stream"}},
+					Body:     CreatePactRequestBody(`{"Key":"Value"}`),
+				},
+				Response: ProviderServiceResponse{
+					Status:   200,
+					Encoding: expectedDataStructure.Response.Encoding,
+					Body:     CreatePactRequestBody(`{"Key":"Value"}`),
+				},
+			},
+		},
+		Messages: []MessageInteraction{
+			{
+				Type:        InteractionTypeAsynchronousMessages,
+				Description: "A user created event",
+				Message: Message{
+					Contents: CreatePactRequestBody(`{"name":"Joe"}`),
+					Encoding: expectedDataStructure.Response.Encoding,
+					Metadata: map[string]interface{}{"topic": "users"},
+				},
+			},
+		},
+		Metadata: PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV4}},
+	}
+
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.NotContains(t, string(marshaled), `"encoding"`, "Encodings should be held in the body metadata")
+	assert.Contains(t, string(marshaled), `"contentType":"application/protobuf; message=BarRequestMessage"`)
+	assert.Contains(t, string(marshaled), `"type":"Synchronous/HTTP"`)
+	assert.Contains(t, string(marshaled), `"type":"Asynchronous/Messages"`)
+
+	unmarshaledContract := PactContract{}
+	err = json.Unmarshal(marshaled, &unmarshaledContract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	assert.Len(t, unmarshaledContract.Metadata.Plugins[0].Configuration, 2, "Expected one entry per descriptor set")
+	unmarshaledContract.Metadata.Plugins = nil
+	// The plugin configuration holds the descriptors as base64, so they're read back in that form
+	contract.CompactFileDescriptorSets()
+	assert.Equal(t, contract, unmarshaledContract, "Expected v4 contract to round-trip")
+}
+
+func TestV4ContractRoundTripsWithNonProtobufEncodings(t *testing.T) {
+	// Descriptions of types without a registered description are read back as raw JSON
+	avroEncoding := &SerializationEncoding{
+		Type:        "avro",
+		Description: json.RawMessage(`{"writerSchema":"\"string\"","schemaRegistry":{"schemaId":7}}`),
+	}
+	contract := PactContract{
+		Consumer: ConsumerOrProvider{Name: "Consumer"},
+		Provider: ConsumerOrProvider{Name: "Provider"},
+		Interactions: []ProviderServiceInteraction{
+			{
+				Description: "Get a user",
+				Request:     ProviderServiceRequest{Method: "GET", Path: &PossiblyRegexedString{NoRegex: "/users/1"}},
+				Response: ProviderServiceResponse{
+					Status:   200,
+					Encoding: &SerializationEncoding{Type: "msgpack"},
+					Body:     CreatePactRequestBody(`{"name":"Joe"}`),
+				},
+			},
+		},
+		Messages: []MessageInteraction{
+			{
+				Type:        InteractionTypeAsynchronousMessages,
+				Description: "A user created event",
+				Message:     Message{Contents: CreatePactRequestBody(`"Joe"`), Encoding: avroEncoding},
+			},
+		},
+		Metadata: PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV4}},
+	}
+
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.NotContains(t, string(marshaled), `"plugins"`, "Only protobuf encodings need the plugin configuration")
+
+	unmarshaledContract := PactContract{}
+	err = json.Unmarshal(marshaled, &unmarshaledContract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	assert.Equal(t, contract, unmarshaledContract, "Expected v4 contract to round-trip")
+}
+
+func TestV4SynchronousMessageResponsesKeepTheirOwnMessageTypes(t *testing.T) {
+	protobufEncoding := func(messageName string, descriptors string) *SerializationEncoding {
+		return &SerializationEncoding{
+			Type:        "protobuf",
+			Description: &ProtobufEncodingDescription{MessageName: messageName, FileDescriptorSetBase64: descriptors},
+		}
+	}
+	contract := PactContract{
+		Consumer: ConsumerOrProvider{Name: "Consumer"},
+		Provider: ConsumerOrProvider{Name: "Provider"},
+		Messages: []MessageInteraction{
+			{
+				Type:        InteractionTypeSynchronousMessages,
+				Description: "Get a user",
+				Request:     &Message{Contents: CreatePactRequestBody(`{"id":1}`), Encoding: protobufEncoding("GetUser", "AQID")},
+				Response: []Message{
+					{Contents: CreatePactRequestBody(`{"name":"Joe"}`), Encoding: protobufEncoding("User", "AQID")},
+					{Contents: CreatePactRequestBody(`{"code":5}`), Encoding: protobufEncoding("Error", "BAUG")},
+				},
+			},
+		},
+		Interactions: []ProviderServiceInteraction{},
+		Metadata:     PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV4}},
+	}
+
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.Contains(t, string(marshaled), `"contentType":"application/protobuf; message=User"`)
+	assert.Contains(t, string(marshaled), `"contentType":"application/protobuf; message=Error"`)
+
+	unmarshaledContract := PactContract{}
+	err = json.Unmarshal(marshaled, &unmarshaledContract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	unmarshaledContract.Metadata.Plugins = nil
+	assert.Equal(t, contract, unmarshaledContract, "Expected each response to keep its own descriptors")
+}
+
+func TestV4ContractKeepsSchemaRegistryFraming(t *testing.T) {
+	message := func(description string, encoding *SerializationEncoding) MessageInteraction {
+		return MessageInteraction{
+			Type:        InteractionTypeAsynchronousMessages,
+			Description: description,
+			Message:     Message{Contents: CreatePactRequestBody(`{"name":"Joe"}`), Encoding: encoding},
+		}
+	}
+	contract := PactContract{
+		Consumer: ConsumerOrProvider{Name: "Consumer"},
+		Provider: ConsumerOrProvider{Name: "Provider"},
+		Messages: []MessageInteraction{
+			message("A user created event", &SerializationEncoding{
+				Type: "protobuf",
+				Description: &ProtobufEncodingDescription{
+					MessageName:             "events.Created",
+					FileDescriptorSetBase64: "AQID",
+					SchemaRegistry:          &SchemaRegistryFraming{Subject: "users-value", SchemaId: 7},
+				},
+			}),
+			message("A user updated event", &SerializationEncoding{
+				Type:        "avro",
+				Description: json.RawMessage(`{"writerSchema":"\"string\"","schemaRegistry":{"schemaId":9}}`),
+			}),
+		},
+		Interactions: []ProviderServiceInteraction{},
+		Metadata:     PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV4}},
+	}
+
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+
+	unmarshaledContract := PactContract{}
+	err = json.Unmarshal(marshaled, &unmarshaledContract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	unmarshaledContract.Metadata.Plugins = nil
+	assert.Equal(t, contract, unmarshaledContract, "Expected the framing to round-trip")
+}
+
+func TestPreV4ContractsStillLoad(t *testing.T) {
+	contract := PactContract{
+		Interactions: []ProviderServiceInteraction{*expectedDataStructure},
+		Metadata:     PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV2}},
+	}
+	marshaled, err := json.Marshal(contract)
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.Contains(t, string(marshaled), `"encoding"`, "Pre-v4 contracts keep their encoding field")
+
+	unmarshaledContract := PactContract{}
+	err = json.Unmarshal(marshaled, &unmarshaledContract)
+	assert.NoError(t, err, "Unmarshaling JSON should succeed")
+	assert.Equal(t, contract, unmarshaledContract, "Expected v2 contract to round-trip")
+}
+
+func TestDescriptorsCompactedToBase64(t *testing.T) {
+	contract := PactContract{
+		Interactions: []ProviderServiceInteraction{*expectedDataStructure},
+		Metadata:     PactContractMetadata{PactSpecification: PactSpecificationDescription{Version: PactSpecificationV2}},
+	}
+
+	contract.CompactFileDescriptorSets()
+	marshaled, err := json.Marshal(contract)
+
+	assert.NoError(t, err, "Marshaling JSON should succeed")
+	assert.NotContains(t, string(marshaled), `"fileDescriptorSet":`)
+	assert.Contains(t, string(marshaled), `"fileDescriptorSetBase64":"AQID"`)
+	descriptorBytes, err := contract.Interactions[0].Request.Encoding.GetProtobufDescription().GetFileDescriptorSetBytes()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3}, descriptorBytes)
+	// The encodings are copied rather than changed in place
+	assert.Equal(t, []float64{1, 2, 3}, expectedDataStructure.Request.Encoding.GetProtobufDescription().FileDescriptorSet)
+}
+
+func TestUnregisteredEncodingDescriptionKeptAsJson(t *testing.T) {
+	encoding := SerializationEncoding{}
+
+	err := json.Unmarshal([]byte(`{"type":"in-house","description":{"schema":"users-v2"}}`), &encoding)
+	assert.NoError(t, err)
+	assert.Equal(t, json.RawMessage(`{"schema":"users-v2"}`), encoding.Description)
+	assert.Nil(t, encoding.GetProtobufDescription())
+
+	marshaled, err := json.Marshal(encoding)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"Type":"in-house","Description":{"schema":"users-v2"}}`, string(marshaled))
+}
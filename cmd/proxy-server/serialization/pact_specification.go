@@ -0,0 +1,124 @@
+package serialization
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	PactSpecificationV2 = "2.0.0"
+	PactSpecificationV3 = "3.0.0"
+)
+
+// Pact v3 matching rules are grouped by category, rather than being keyed by a JSON path from the root of the request
+// or response (e.g. {"body": {"$.name": {"matchers": [...]}}} rather than {"$.body.name": {...}}).
+var matchingRuleCategories = []string{"body", "header", "path", "query"}
+
+func (contract *PactContract) SpecificationMajorVersion() int {
+	major, err := strconv.Atoi(strings.SplitN(contract.Metadata.PactSpecification.Version, ".", 2)[0])
+	if err != nil {
+		return 2
+	}
+	return major
+}
+
+// Brings the contract into line with the specification version it uses: if v3 features have been used then the
+// contract is upgraded to v3, and a v3 contract has its v2-style provider states and queries converted.
+func (contract *PactContract) NormaliseForSpecificationVersion() {
+	if contract.SpecificationMajorVersion() < 3 && contract.usesV3Features() {
+		contract.Metadata.PactSpecification.Version = PactSpecificationV3
+	}
+	if contract.Metadata.PactSpecification.Version == "" {
+		contract.Metadata.PactSpecification.Version = PactSpecificationV2
+	}
+	if contract.SpecificationMajorVersion() < 3 {
+		return
+	}
+
+	for i := range contract.Interactions {
+		interaction := &contract.Interactions[i]
+		if interaction.ProviderState != "" && len(interaction.ProviderStates) == 0 {
+			interaction.ProviderStates = []ProviderState{{Name: interaction.ProviderState}}
+		}
+		interaction.ProviderState = ""
+
+		query := interaction.Request.Query
+		if query != nil && query.QueryMap == nil && query.WithRegex == nil {
+			parsedQuery, err := url.ParseQuery(strings.TrimPrefix(query.NoRegex, "?"))
+			if err == nil {
+				interaction.Request.Query = &PossiblyRegexedString{QueryMap: parsedQuery}
+			}
+		}
+	}
+	for i := range contract.Messages {
+		message := &contract.Messages[i]
+		if message.ProviderState != "" && len(message.ProviderStates) == 0 {
+			message.ProviderStates = []ProviderState{{Name: message.ProviderState}}
+		}
+		message.ProviderState = ""
+	}
+}
+
+// Message pacts were introduced in v3, so their presence alone means the contract is v3.
+func (contract *PactContract) usesV3Features() bool {
+	if len(contract.Messages) > 0 {
+		return true
+	}
+	for _, interaction := range contract.Interactions {
+		if len(interaction.ProviderStates) > 0 ||
+			(interaction.Request.Query != nil && interaction.Request.Query.QueryMap != nil) ||
+			interaction.Request.Generators != nil || interaction.Response.Generators != nil ||
+			IsV3MatchingRules(interaction.Request.MatchingRules) || IsV3MatchingRules(interaction.Response.MatchingRules) {
+			return true
+		}
+	}
+	return false
+}
+
+func IsV3MatchingRules(matchingRules interface{}) bool {
+	rules, isMap := matchingRules.(map[string]interface{})
+	if !isMap {
+		return false
+	}
+	for _, category := range matchingRuleCategories {
+		if _, present := rules[category]; present {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the matching rules for a single category of v3 matching rules, keyed by path within that category (which
+// for the "body" category are JSON paths rooted at "$").
+func GetV3MatchingRuleCategory(matchingRules interface{}, category string) map[string]interface{} {
+	rules, isMap := matchingRules.(map[string]interface{})
+	if !isMap {
+		return nil
+	}
+	categoryRules, _ := rules[category].(map[string]interface{})
+	return categoryRules
+}
+
+// Returns the regex applied to the request path by the matching rules, in either the v2 or v3 form, or "" if the path
+// isn't matched by regex.
+func GetPathRegexFromMatchingRules(matchingRules interface{}) string {
+	rules, isMap := matchingRules.(map[string]interface{})
+	if !isMap {
+		return ""
+	}
+	if v2Rule, isMap := rules["$.path"].(map[string]interface{}); isMap {
+		regex, _ := v2Rule["regex"].(string)
+		return regex
+	}
+	pathRules := GetV3MatchingRuleCategory(matchingRules, "path")
+	matchers, _ := pathRules["matchers"].([]interface{})
+	for _, matcher := range matchers {
+		if matcherMap, isMap := matcher.(map[string]interface{}); isMap {
+			if regex, hasRegex := matcherMap["regex"].(string); hasRegex {
+				return regex
+			}
+		}
+	}
+	return ""
+}
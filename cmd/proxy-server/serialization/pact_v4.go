@@ -0,0 +1,591 @@
+package serialization
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/url"
+	"strings"
+)
+
+const (
+	PactSpecificationV4 = "4.0"
+
+	InteractionTypeHttp                 = "Synchronous/HTTP"
+	InteractionTypeAsynchronousMessages = "Asynchronous/Messages"
+	InteractionTypeSynchronousMessages  = "Synchronous/Messages"
+)
+
+// In Pact v4 the content type is carried per body: protobuf bodies are given a content type of the form
+// "application/protobuf; message=<messageName>", and (as with the Pact protobuf plugin) the descriptors are stored
+// once in the plugin configuration of the contract metadata and referenced from each interaction by key.
+const (
+	protobufPluginName          = "protobuf"
+	protobufContentType         = "application/protobuf"
+	protobufMessageParameter    = "message"
+	protobufDescriptorsField    = "protoDescriptors"
+	descriptorKeyField          = "descriptorKey"
+	requestDescriptorKeyField   = "requestDescriptorKey"   // Only present if the request uses different descriptors
+	responseDescriptorKeysField = "responseDescriptorKeys" // Only present if the responses use different descriptors
+	defaultJsonContentType      = "application/json"
+	v4BodyEncodedAsBase64       = "base64"
+	v4BodyEncodedAsJsonString   = "json"
+)
+
+// Encodings other than protobuf have no plugin to describe them, so they're written alongside the body's content, as
+// is the schema registry framing of protobuf bodies.
+type v4Body struct {
+	Content        json.RawMessage        `json:"content,omitempty"`
+	ContentType    string                 `json:"contentType,omitempty"`
+	Encoded        interface{}            `json:"encoded"` // Either false, "base64" or "json"
+	Encoding       *SerializationEncoding `json:"encoding,omitempty"`
+	SchemaRegistry *SchemaRegistryFraming `json:"schemaRegistry,omitempty"`
+}
+
+type v4HttpRequest struct {
+	Method        string              `json:"method"`
+	Path          string              `json:"path"`
+	Query         map[string][]string `json:"query,omitempty"`
+	Headers       interface{}         `json:"headers,omitempty"`
+	Body          *v4Body             `json:"body,omitempty"`
+	MatchingRules interface{}         `json:"matchingRules,omitempty"`
+	Generators    interface{}         `json:"generators,omitempty"`
+}
+
+type v4HttpResponse struct {
+	Status        int         `json:"status"`
+	Headers       interface{} `json:"headers,omitempty"`
+	Body          *v4Body     `json:"body,omitempty"`
+	MatchingRules interface{} `json:"matchingRules,omitempty"`
+	Generators    interface{} `json:"generators,omitempty"`
+}
+
+type v4MessageContents struct {
+	Contents      *v4Body                `json:"contents,omitempty"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	MatchingRules interface{}            `json:"matchingRules,omitempty"`
+	Generators    interface{}            `json:"generators,omitempty"`
+}
+
+// The shape of the request and response depends on the interaction type, so these are decoded once that's known.
+type v4Interaction struct {
+	Type                string                            `json:"type"`
+	Description         string                            `json:"description"`
+	ProviderStates      []ProviderState                   `json:"providerStates,omitempty"`
+	PluginConfiguration map[string]map[string]interface{} `json:"pluginConfiguration,omitempty"`
+	Request             json.RawMessage                   `json:"request,omitempty"`
+	Response            json.RawMessage                   `json:"response,omitempty"`
+	v4MessageContents
+}
+
+type v4Contract struct {
+	Consumer     ConsumerOrProvider   `json:"consumer"`
+	Provider     ConsumerOrProvider   `json:"provider"`
+	Interactions []v4Interaction      `json:"interactions"`
+	Metadata     PactContractMetadata `json:"metadata"`
+}
+
+// Descriptor sets, keyed by the hex MD5 of their bytes
+type v4Descriptors map[string][]byte
+
+func (descriptors v4Descriptors) add(encoding *SerializationEncoding) string {
+	if !isProtobufEncoding(encoding) {
+		return ""
+	}
+	descriptorBytes, err := encoding.GetProtobufDescription().GetFileDescriptorSetBytes()
+	if err != nil {
+		return ""
+	}
+	hash := md5.Sum(descriptorBytes)
+	key := hex.EncodeToString(hash[:])
+	descriptors[key] = descriptorBytes
+	return key
+}
+
+func isProtobufEncoding(encoding *SerializationEncoding) bool {
+	return encoding.GetProtobufDescription() != nil
+}
+
+func (contract *PactContract) marshalV4() ([]byte, error) {
+	descriptors := v4Descriptors{}
+	v4 := v4Contract{
+		Consumer:     contract.Consumer,
+		Provider:     contract.Provider,
+		Interactions: make([]v4Interaction, 0, len(contract.Interactions)+len(contract.Messages)),
+		Metadata:     contract.Metadata,
+	}
+
+	for i := range contract.Interactions {
+		interaction, err := httpInteractionToV4(&contract.Interactions[i], descriptors)
+		if err != nil {
+			return nil, err
+		}
+		v4.Interactions = append(v4.Interactions, interaction)
+	}
+	for i := range contract.Messages {
+		interaction, err := messageInteractionToV4(&contract.Messages[i], descriptors)
+		if err != nil {
+			return nil, err
+		}
+		v4.Interactions = append(v4.Interactions, interaction)
+	}
+
+	v4.Metadata.Plugins = withProtobufPluginDescriptors(contract.Metadata.Plugins, descriptors)
+	return json.Marshal(v4)
+}
+
+func withProtobufPluginDescriptors(plugins []PactPlugin, descriptors v4Descriptors) []PactPlugin {
+	if len(descriptors) == 0 {
+		return plugins
+	}
+	configuration := map[string]interface{}{}
+	for key, descriptorBytes := range descriptors {
+		configuration[key] = map[string]interface{}{
+			protobufDescriptorsField: base64.StdEncoding.EncodeToString(descriptorBytes),
+		}
+	}
+
+	updatedPlugins := make([]PactPlugin, 0, len(plugins)+1)
+	for _, plugin := range plugins {
+		if plugin.Name == protobufPluginName {
+			for key, value := range plugin.Configuration {
+				if _, present := configuration[key]; !present {
+					configuration[key] = value
+				}
+			}
+			continue
+		}
+		updatedPlugins = append(updatedPlugins, plugin)
+	}
+	return append(updatedPlugins, PactPlugin{Name: protobufPluginName, Configuration: configuration})
+}
+
+// The interaction's descriptor key refers to the response descriptors where present, as in the Pact protobuf plugin.
+func pluginConfigurationForDescriptorKeys(requestKey string, responseKey string) map[string]map[string]interface{} {
+	if requestKey == "" && responseKey == "" {
+		return nil
+	}
+	configuration := map[string]interface{}{}
+	if responseKey == "" {
+		configuration[descriptorKeyField] = requestKey
+	} else {
+		configuration[descriptorKeyField] = responseKey
+		if requestKey != "" && requestKey != responseKey {
+			configuration[requestDescriptorKeyField] = requestKey
+		}
+	}
+	return map[string]map[string]interface{}{protobufPluginName: configuration}
+}
+
+func httpInteractionToV4(interaction *ProviderServiceInteraction, descriptors v4Descriptors) (v4Interaction, error) {
+	request := v4HttpRequest{
+		Method:        interaction.Request.Method,
+		Headers:       headersToV4(interaction.Request.Headers),
+		Body:          bodyToV4(interaction.Request.Body, interaction.Request.Encoding, interaction.Request.Headers),
+		MatchingRules: interaction.Request.MatchingRules,
+		Generators:    interaction.Request.Generators,
+	}
+	if interaction.Request.Path != nil {
+		request.Path = interaction.Request.Path.GetString()
+	}
+	if interaction.Request.Query != nil {
+		query, err := queryToV4(interaction.Request.Query)
+		if err != nil {
+			return v4Interaction{}, err
+		}
+		request.Query = query
+	}
+	response := v4HttpResponse{
+		Status:        interaction.Response.Status,
+		Headers:       headersToV4(interaction.Response.Headers),
+		Body:          bodyToV4(interaction.Response.Body, interaction.Response.Encoding, interaction.Response.Headers),
+		MatchingRules: interaction.Response.MatchingRules,
+		Generators:    interaction.Response.Generators,
+	}
+
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return v4Interaction{}, err
+	}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		return v4Interaction{}, err
+	}
+	return v4Interaction{
+		Type:           InteractionTypeHttp,
+		Description:    interaction.Description,
+		ProviderStates: providerStatesToV4(interaction.ProviderState, interaction.ProviderStates),
+		PluginConfiguration: pluginConfigurationForDescriptorKeys(
+			descriptors.add(interaction.Request.Encoding), descriptors.add(interaction.Response.Encoding)),
+		Request:  requestJson,
+		Response: responseJson,
+	}, nil
+}
+
+func messageInteractionToV4(interaction *MessageInteraction, descriptors v4Descriptors) (v4Interaction, error) {
+	v4 := v4Interaction{
+		Type:           interaction.Type,
+		Description:    interaction.Description,
+		ProviderStates: providerStatesToV4(interaction.ProviderState, interaction.ProviderStates),
+	}
+	if v4.Type == "" {
+		v4.Type = InteractionTypeAsynchronousMessages
+		if interaction.Request != nil {
+			v4.Type = InteractionTypeSynchronousMessages
+		}
+	}
+
+	if v4.Type == InteractionTypeAsynchronousMessages {
+		v4.v4MessageContents = messageToV4(&interaction.Message)
+		v4.PluginConfiguration = pluginConfigurationForDescriptorKeys("", descriptors.add(interaction.Encoding))
+		return v4, nil
+	}
+
+	requestKey := ""
+	if interaction.Request != nil {
+		requestJson, err := json.Marshal(messageToV4(interaction.Request))
+		if err != nil {
+			return v4Interaction{}, err
+		}
+		v4.Request = requestJson
+		requestKey = descriptors.add(interaction.Request.Encoding)
+	}
+	responses := make([]v4MessageContents, 0, len(interaction.Response))
+	responseKeys := make([]interface{}, 0, len(interaction.Response))
+	responseKey := ""
+	keysDiffer := false
+	for i := range interaction.Response {
+		responses = append(responses, messageToV4(&interaction.Response[i]))
+		key := descriptors.add(interaction.Response[i].Encoding)
+		if responseKey == "" {
+			responseKey = key
+		}
+		keysDiffer = keysDiffer || (key != "" && key != responseKey)
+		responseKeys = append(responseKeys, key)
+	}
+	responseJson, err := json.Marshal(responses)
+	if err != nil {
+		return v4Interaction{}, err
+	}
+	v4.Response = responseJson
+	v4.PluginConfiguration = pluginConfigurationForDescriptorKeys(requestKey, responseKey)
+	if keysDiffer {
+		v4.PluginConfiguration[protobufPluginName][responseDescriptorKeysField] = responseKeys
+	}
+	return v4, nil
+}
+
+func messageToV4(message *Message) v4MessageContents {
+	return v4MessageContents{
+		Contents:      bodyToV4(message.Contents, message.Encoding, nil),
+		Metadata:      message.Metadata,
+		MatchingRules: message.MatchingRules,
+		Generators:    message.Generators,
+	}
+}
+
+func providerStatesToV4(providerState string, providerStates []ProviderState) []ProviderState {
+	if len(providerStates) == 0 && providerState != "" {
+		return []ProviderState{{Name: providerState}}
+	}
+	return providerStates
+}
+
+func queryToV4(query *PossiblyRegexedString) (map[string][]string, error) {
+	if query.QueryMap != nil {
+		return query.QueryMap, nil
+	}
+	parsedQuery, err := url.ParseQuery(strings.TrimPrefix(query.GetString(), "?"))
+	if err != nil {
+		return nil, err
+	}
+	return parsedQuery, nil
+}
+
+// Pact v4 header values are always arrays.
+func headersToV4(headers interface{}) interface{} {
+	headerMap, isMap := headers.(map[string]interface{})
+	if !isMap {
+		return headers
+	}
+	v4Headers := make(map[string]interface{}, len(headerMap))
+	for name, value := range headerMap {
+		if stringValue, isString := value.(string); isString {
+			v4Headers[name] = []string{stringValue}
+		} else {
+			v4Headers[name] = value
+		}
+	}
+	return v4Headers
+}
+
+func contentTypeFromHeaders(headers interface{}) string {
+	headerMap, isMap := headers.(map[string]interface{})
+	if !isMap {
+		return ""
+	}
+	for name, value := range headerMap {
+		if strings.ToLower(name) != "content-type" {
+			continue
+		}
+		switch typedValue := value.(type) {
+		case string:
+			return typedValue
+		case []interface{}:
+			if len(typedValue) > 0 {
+				contentType, _ := typedValue[0].(string)
+				return contentType
+			}
+		}
+	}
+	return ""
+}
+
+func bodyToV4(body *PactRequestBody, encoding *SerializationEncoding, headers interface{}) *v4Body {
+	if body == nil {
+		return nil
+	}
+	contentType := contentTypeFromHeaders(headers)
+	if isProtobufEncoding(encoding) {
+		contentType = mime.FormatMediaType(protobufContentType,
+			map[string]string{protobufMessageParameter: encoding.GetProtobufDescription().MessageName})
+	} else if contentType == "" {
+		contentType = defaultJsonContentType
+	}
+	v4 := &v4Body{
+		Content:     json.RawMessage(body.GetString()),
+		ContentType: contentType,
+		Encoded:     false,
+	}
+	if isProtobufEncoding(encoding) {
+		v4.SchemaRegistry = encoding.GetProtobufDescription().SchemaRegistry
+	} else if encoding != nil {
+		v4.Encoding = encoding
+	}
+	return v4
+}
+
+func (contract *PactContract) unmarshalV4(data []byte) error {
+	v4 := v4Contract{}
+	err := json.Unmarshal(data, &v4)
+	if err != nil {
+		return err
+	}
+
+	contract.Consumer = v4.Consumer
+	contract.Provider = v4.Provider
+	contract.Metadata = v4.Metadata
+	contract.Interactions = []ProviderServiceInteraction{}
+	contract.Messages = nil
+	for i := range v4.Interactions {
+		interaction := &v4.Interactions[i]
+		switch interaction.Type {
+		case InteractionTypeHttp, "":
+			httpInteraction, err := httpInteractionFromV4(interaction, v4.Metadata.Plugins)
+			if err != nil {
+				return err
+			}
+			contract.Interactions = append(contract.Interactions, httpInteraction)
+		case InteractionTypeAsynchronousMessages, InteractionTypeSynchronousMessages:
+			messageInteraction, err := messageInteractionFromV4(interaction, v4.Metadata.Plugins)
+			if err != nil {
+				return err
+			}
+			contract.Messages = append(contract.Messages, messageInteraction)
+		default:
+			return fmt.Errorf("interaction %q has unsupported type %q", interaction.Description, interaction.Type)
+		}
+	}
+	return nil
+}
+
+func descriptorKeys(interaction *v4Interaction) (string, string) {
+	configuration := interaction.PluginConfiguration[protobufPluginName]
+	responseKey, _ := configuration[descriptorKeyField].(string)
+	requestKey, _ := configuration[requestDescriptorKeyField].(string)
+	if requestKey == "" {
+		requestKey = responseKey
+	}
+	return requestKey, responseKey
+}
+
+func httpInteractionFromV4(interaction *v4Interaction, plugins []PactPlugin) (ProviderServiceInteraction, error) {
+	request := v4HttpRequest{}
+	response := v4HttpResponse{}
+	err := json.Unmarshal(interaction.Request, &request)
+	if err != nil {
+		return ProviderServiceInteraction{}, err
+	}
+	if len(interaction.Response) > 0 {
+		err = json.Unmarshal(interaction.Response, &response)
+		if err != nil {
+			return ProviderServiceInteraction{}, err
+		}
+	}
+
+	requestKey, responseKey := descriptorKeys(interaction)
+	requestBody, requestEncoding, err := bodyFromV4(request.Body, requestKey, plugins)
+	if err != nil {
+		return ProviderServiceInteraction{}, err
+	}
+	responseBody, responseEncoding, err := bodyFromV4(response.Body, responseKey, plugins)
+	if err != nil {
+		return ProviderServiceInteraction{}, err
+	}
+
+	httpInteraction := ProviderServiceInteraction{
+		Description:    interaction.Description,
+		ProviderStates: interaction.ProviderStates,
+		Request: ProviderServiceRequest{
+			Method:        request.Method,
+			Path:          &PossiblyRegexedString{NoRegex: request.Path},
+			Encoding:      requestEncoding,
+			Headers:       request.Headers,
+			Body:          requestBody,
+			MatchingRules: request.MatchingRules,
+			Generators:    request.Generators,
+		},
+		Response: ProviderServiceResponse{
+			Status:        response.Status,
+			Encoding:      responseEncoding,
+			Headers:       response.Headers,
+			Body:          responseBody,
+			MatchingRules: response.MatchingRules,
+			Generators:    response.Generators,
+		},
+	}
+	if request.Query != nil {
+		httpInteraction.Request.Query = &PossiblyRegexedString{QueryMap: request.Query}
+	}
+	return httpInteraction, nil
+}
+
+func messageInteractionFromV4(interaction *v4Interaction, plugins []PactPlugin) (MessageInteraction, error) {
+	messageInteraction := MessageInteraction{
+		Type:           interaction.Type,
+		Description:    interaction.Description,
+		ProviderStates: interaction.ProviderStates,
+	}
+	requestKey, responseKey := descriptorKeys(interaction)
+
+	if interaction.Type == InteractionTypeAsynchronousMessages {
+		message, err := messageFromV4(&interaction.v4MessageContents, responseKey, plugins)
+		if err != nil {
+			return MessageInteraction{}, err
+		}
+		messageInteraction.Message = message
+		return messageInteraction, nil
+	}
+
+	if len(interaction.Request) > 0 {
+		request := v4MessageContents{}
+		err := json.Unmarshal(interaction.Request, &request)
+		if err != nil {
+			return MessageInteraction{}, err
+		}
+		message, err := messageFromV4(&request, requestKey, plugins)
+		if err != nil {
+			return MessageInteraction{}, err
+		}
+		messageInteraction.Request = &message
+	}
+	if len(interaction.Response) > 0 {
+		responses := []v4MessageContents{}
+		err := json.Unmarshal(interaction.Response, &responses)
+		if err != nil {
+			return MessageInteraction{}, err
+		}
+		responseKeys, _ := interaction.PluginConfiguration[protobufPluginName][responseDescriptorKeysField].([]interface{})
+		for i := range responses {
+			key := responseKey
+			if i < len(responseKeys) {
+				key, _ = responseKeys[i].(string)
+			}
+			message, err := messageFromV4(&responses[i], key, plugins)
+			if err != nil {
+				return MessageInteraction{}, err
+			}
+			messageInteraction.Response = append(messageInteraction.Response, message)
+		}
+	}
+	return messageInteraction, nil
+}
+
+func messageFromV4(contents *v4MessageContents, descriptorKey string, plugins []PactPlugin) (Message, error) {
+	body, encoding, err := bodyFromV4(contents.Contents, descriptorKey, plugins)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Contents:      body,
+		Encoding:      encoding,
+		Metadata:      contents.Metadata,
+		MatchingRules: contents.MatchingRules,
+		Generators:    contents.Generators,
+	}, nil
+}
+
+// Bodies are held as the example JSON: binary bodies encoded as base64 (as the Pact protobuf plugin writes them) can't
+// be converted to JSON at this point, as the descriptors may not be resolvable yet.
+func bodyFromV4(body *v4Body, descriptorKey string, plugins []PactPlugin) (*PactRequestBody, *SerializationEncoding, error) {
+	if body == nil {
+		return nil, nil, nil
+	}
+
+	content := body.Content
+	switch encoded := body.Encoded.(type) {
+	case string:
+		if strings.ToLower(encoded) == v4BodyEncodedAsJsonString {
+			var jsonString string
+			err := json.Unmarshal(content, &jsonString)
+			if err != nil {
+				return nil, nil, err
+			}
+			content = json.RawMessage(jsonString)
+		}
+	}
+
+	mediaType, parameters, err := mime.ParseMediaType(body.ContentType)
+	if err != nil || (mediaType != protobufContentType && mediaType != "application/x-protobuf") {
+		return CreatePactRequestBody(string(content)), body.Encoding, nil
+	}
+	if encoded, isString := body.Encoded.(string); isString && strings.ToLower(encoded) == v4BodyEncodedAsBase64 {
+		return nil, nil, fmt.Errorf("base64 encoded protobuf bodies are not supported, the example JSON is required")
+	}
+
+	descriptorSet, err := protobufDescriptorsFromPlugins(plugins, descriptorKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	encoding := &SerializationEncoding{
+		Type: "protobuf",
+		Description: &ProtobufEncodingDescription{
+			MessageName:             parameters[protobufMessageParameter],
+			FileDescriptorSetBase64: descriptorSet,
+			SchemaRegistry:          body.SchemaRegistry,
+		},
+	}
+	return CreatePactRequestBody(string(content)), encoding, nil
+}
+
+func protobufDescriptorsFromPlugins(plugins []PactPlugin, descriptorKey string) (string, error) {
+	for _, plugin := range plugins {
+		if plugin.Name != protobufPluginName {
+			continue
+		}
+		entry, isMap := plugin.Configuration[descriptorKey].(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		encodedDescriptors, _ := entry[protobufDescriptorsField].(string)
+		_, err := base64.StdEncoding.DecodeString(encodedDescriptors)
+		if err != nil {
+			return "", err
+		}
+		return encodedDescriptors, nil
+	}
+	return "", fmt.Errorf("no protobuf descriptors found in the contract metadata for key %q", descriptorKey)
+}